@@ -3,11 +3,13 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"os/exec"
 	"schedulerV2/models"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/samuel/go-zookeeper/zk"
@@ -23,10 +25,29 @@ var (
 	Env          string
 	mu           sync.Mutex
 	once         sync.Once
+	zkClosed     atomic.Bool
+	dbClosed     bool
 )
 
 var lg = GetLogger(true)
 
+const (
+	defaultCallbackBatchMaxItems  = 100
+	defaultCallbackBatchMaxBytes  = 1 << 20
+	defaultCallbackTimeout        = 30
+	defaultCallbackTimeoutMax     = 300
+	defaultCallbackResultMaxBytes = 64 << 10
+	defaultClaimLease             = 600
+	defaultMaxOrphanings          = 3
+	defaultShutdownTimeout        = 25
+	defaultRetentionDays          = 30
+	defaultRetentionBatchSize     = 1000
+	defaultRetentionInterval      = 300
+	defaultPartitionDays          = 7
+	defaultPartitionPremake       = 4
+	defaultPartitionInterval      = 3600
+)
+
 func LoadConfig() error {
 
 	Env = os.Getenv("APP_ENV")
@@ -45,8 +66,30 @@ func LoadConfig() error {
 		return fmt.Errorf("failed to unmarshal config data: %w", err)
 	}
 
+	if models.AppConfig.ClaimMode == "" {
+		models.AppConfig.ClaimMode = models.ClaimLock
+	}
+
+	if models.AppConfig.ClaimMode != models.ClaimLock && models.AppConfig.ClaimMode != models.ClaimSkipLocked {
+		return fmt.Errorf("invalid claim_mode value in the config file")
+	}
+
+	// The skip_locked claim mode runs without ZooKeeper unless it is asked for
+	if models.AppConfig.LockBackend == "" {
+		models.AppConfig.LockBackend = models.LockZookeeper
+		if models.AppConfig.ClaimMode == models.ClaimSkipLocked {
+			models.AppConfig.LockBackend = models.LockPostgres
+		}
+	}
+
+	switch models.AppConfig.LockBackend {
+	case models.LockZookeeper, models.LockPostgres, models.LockMemory:
+	default:
+		return fmt.Errorf("invalid lock_backend value in the config file")
+	}
+
 	// Validate ZooKeeper hosts
-	if len(models.AppConfig.ZookeeperHosts) == 0 {
+	if models.AppConfig.LockBackend == models.LockZookeeper && len(models.AppConfig.ZookeeperHosts) == 0 {
 		return fmt.Errorf("zookeeper_hosts configuration is required")
 	}
 
@@ -58,7 +101,7 @@ func LoadConfig() error {
 		return fmt.Errorf("invalid dlq_message_limit value in the config file")
 	}
 
-	if models.AppConfig.ZookeepeerHeartBeatTime == 0 {
+	if models.AppConfig.LockBackend == models.LockZookeeper && models.AppConfig.ZookeepeerHeartBeatTime == 0 {
 		return fmt.Errorf("invalid zookeeper_heart_beat_time value in the config file")
 	}
 
@@ -74,6 +117,160 @@ func LoadConfig() error {
 		return fmt.Errorf("OtelExporterOtlpEndpoint value cannot be null")
 	}
 
+	if models.AppConfig.CallbackBatchMaxItems < 0 || models.AppConfig.CallbackBatchMaxBytes < 0 {
+		return fmt.Errorf("invalid callback batch limits in the config file")
+	}
+
+	if models.AppConfig.CallbackBatchMaxItems == 0 {
+		models.AppConfig.CallbackBatchMaxItems = defaultCallbackBatchMaxItems
+	}
+
+	if models.AppConfig.CallbackBatchMaxBytes == 0 {
+		models.AppConfig.CallbackBatchMaxBytes = defaultCallbackBatchMaxBytes
+	}
+
+	if models.AppConfig.CallbackTimeoutDefault == 0 {
+		models.AppConfig.CallbackTimeoutDefault = defaultCallbackTimeout
+	}
+
+	if models.AppConfig.CallbackTimeoutMax == 0 {
+		models.AppConfig.CallbackTimeoutMax = defaultCallbackTimeoutMax
+	}
+
+	if models.AppConfig.ClaimLease == 0 {
+		models.AppConfig.ClaimLease = defaultClaimLease
+	}
+
+	if models.AppConfig.ShutdownTimeout < 0 {
+		return fmt.Errorf("invalid shutdown_timeout value in the config file")
+	}
+
+	if models.AppConfig.ShutdownTimeout == 0 {
+		models.AppConfig.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	if models.AppConfig.MaxOrphanings < 0 {
+		return fmt.Errorf("invalid max_orphanings value in the config file")
+	}
+
+	if models.AppConfig.MaxOrphanings == 0 {
+		models.AppConfig.MaxOrphanings = defaultMaxOrphanings
+	}
+
+	// A lease shorter than the longest callback would let another replica claim a message that is still being sent
+	if models.AppConfig.ClaimLease <= models.AppConfig.CallbackTimeoutMax {
+		return fmt.Errorf("claim_lease must be longer than callback_timeout_max")
+	}
+
+	if models.AppConfig.CallbackResultMaxBytes < 0 {
+		return fmt.Errorf("invalid callback_result_max_bytes value in the config file")
+	}
+
+	if models.AppConfig.CallbackResultMaxBytes == 0 {
+		models.AppConfig.CallbackResultMaxBytes = defaultCallbackResultMaxBytes
+	}
+
+	if models.AppConfig.CallbackOutcomes == nil {
+		models.AppConfig.CallbackOutcomes = &models.CallbackOutcomeConfig{
+			EmptyBodySuccess:     true,
+			NonRetryable4xx:      true,
+			Retryable4xxStatuses: []int{http.StatusRequestTimeout, http.StatusTooManyRequests},
+			RetryAfterStatuses:   []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+		}
+	}
+
+	if models.AppConfig.CallbackTransport == nil {
+		models.AppConfig.CallbackTransport = &models.CallbackTransportConfig{
+			MaxIdleConns:        1000,
+			MaxIdleConnsPerHost: 100,
+			MaxConnsPerHost:     200,
+			IdleConnTimeout:     90,
+			KeepAlive:           30,
+			DialTimeout:         5,
+			TLSHandshakeTimeout: 5,
+			HTTP2:               true,
+		}
+	}
+
+	if models.AppConfig.CallbackGuard == nil {
+		models.AppConfig.CallbackGuard = &models.CallbackGuardConfig{Enabled: false}
+	}
+
+	if models.AppConfig.Retention == nil {
+		models.AppConfig.Retention = &models.RetentionConfig{Enabled: false}
+	}
+
+	if retention := models.AppConfig.Retention; retention.Enabled {
+		if retention.Days == 0 {
+			retention.Days = defaultRetentionDays
+		}
+		if retention.Mode == "" {
+			retention.Mode = models.RetentionArchive
+		}
+		if retention.BatchSize == 0 {
+			retention.BatchSize = defaultRetentionBatchSize
+		}
+		if retention.Interval == 0 {
+			retention.Interval = defaultRetentionInterval
+		}
+		if retention.Days < 0 || retention.BatchSize < 0 || retention.Interval < 0 ||
+			(retention.Mode != models.RetentionArchive && retention.Mode != models.RetentionDelete) {
+			return fmt.Errorf("invalid retention values in the config file")
+		}
+	}
+
+	if models.AppConfig.Partitioning == nil {
+		models.AppConfig.Partitioning = &models.PartitioningConfig{Enabled: false}
+	}
+
+	if partitioning := models.AppConfig.Partitioning; partitioning.Enabled {
+		if partitioning.Key == "" {
+			partitioning.Key = models.PartitionByCreatedAt
+		}
+		if partitioning.Days == 0 {
+			partitioning.Days = defaultPartitionDays
+		}
+		if partitioning.Premake == 0 {
+			partitioning.Premake = defaultPartitionPremake
+		}
+		if partitioning.Interval == 0 {
+			partitioning.Interval = defaultPartitionInterval
+		}
+		if partitioning.Days < 0 || partitioning.Premake < 0 || partitioning.Retain < 0 || partitioning.Interval < 0 {
+			return fmt.Errorf("invalid partitioning values in the config file")
+		}
+		if partitioning.Key != models.PartitionByCreatedAt {
+			return fmt.Errorf("invalid partitioning key %q in the config file, message_queue can only be partitioned by %s", partitioning.Key, models.PartitionByCreatedAt)
+		}
+	}
+
+	if models.AppConfig.CircuitBreaker == nil {
+		models.AppConfig.CircuitBreaker = &models.CircuitBreakerConfig{Enabled: false}
+	}
+
+	if cb := models.AppConfig.CircuitBreaker; cb.Enabled && (cb.FailureRatio <= 0 || cb.FailureRatio > 1 || cb.MinRequests <= 0 || cb.Window <= 0 || cb.CoolDown <= 0) {
+		return fmt.Errorf("invalid circuit_breaker values in the config file")
+	}
+
+	if models.AppConfig.CallbackTimeoutDefault < 0 || models.AppConfig.CallbackTimeoutDefault > models.AppConfig.CallbackTimeoutMax {
+		return fmt.Errorf("invalid callback_timeout_default value in the config file")
+	}
+
+	for name, service := range models.AppConfig.Services {
+		if service.RetentionDays < -1 {
+			return fmt.Errorf("service %s has an invalid retention_days", name)
+		}
+		if _, found := models.AppConfig.TLSProfiles[service.TLSProfile]; service.TLSProfile != "" && !found {
+			return fmt.Errorf("service %s references unknown tls_profile %s", name, service.TLSProfile)
+		}
+	}
+
+	for target, grpcTarget := range models.AppConfig.GrpcTargets {
+		if _, found := models.AppConfig.TLSProfiles[grpcTarget.TLSProfile]; grpcTarget.TLSProfile != "" && !found {
+			return fmt.Errorf("grpc target %s references unknown tls_profile %s", target, grpcTarget.TLSProfile)
+		}
+	}
+
 	return nil
 }
 
@@ -99,6 +296,10 @@ func GetDBConnection() (*gorm.DB, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
+	if dbClosed {
+		return nil, fmt.Errorf("database connection is closed")
+	}
+
 	if db == nil {
 		return initDB()
 	}
@@ -159,12 +360,7 @@ func initDB() (*gorm.DB, error) {
 	sqlDB.SetMaxOpenConns(100)
 	sqlDB.SetConnMaxLifetime(10 * time.Minute)
 
-	// Run automigrations
-	if err := db.AutoMigrate(&models.MessageQueue{}, &models.DlqMessageQueue{}, &models.ServiceThreshold{}); err != nil {
-		return nil, fmt.Errorf("failed to run automigrations: %v", err)
-	}
-
-	lg.Info().Msg("Database connection initialized and migrations completed")
+	lg.Info().Msg("Database connection initialized")
 
 	return db, nil
 }
@@ -221,6 +417,9 @@ func InitZooKeeper(servers []string) {
 	// Set up a watcher on the ZooKeeper connection.
 	go func(ec <-chan zk.Event) {
 		for event := range ec {
+			if zkClosed.Load() {
+				return
+			}
 			switch event.State {
 			case zk.StateDisconnected:
 				lg.Info().Msg("ZooKeeper disconnected. Attempting to reconnect...")
@@ -242,3 +441,30 @@ func InitZooKeeper(servers []string) {
 		}
 	}(eventChannel)
 }
+
+// CloseZooKeeper closes the ZooKeeper session, which deletes the ephemeral lock nodes it still holds
+func CloseZooKeeper() {
+	if ZkConn == nil {
+		return
+	}
+	zkClosed.Store(true)
+	ZkConn.Close()
+	lg.Info().Msg("ZooKeeper connection closed")
+}
+
+// CloseDB closes the database connection pool
+func CloseDB() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	dbClosed = true
+	if db == nil {
+		return nil
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	db = nil
+	return sqlDB.Close()
+}
@@ -8,6 +8,7 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
 	"google.golang.org/grpc/credentials"
 
 	"go.opentelemetry.io/otel/sdk/resource"
@@ -18,6 +19,9 @@ func InitTracer() func(context.Context) error {
 
 	var secureOption otlptracegrpc.Option
 
+	// Incoming traceparent headers are extracted by otelgin and injected into callbacks, even without an exporter
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
 	if Env == "local" || Env == "staging" {
 		return nil
 	}
@@ -50,12 +54,13 @@ func InitTracer() func(context.Context) error {
 		lg.Error().Msgf("ZooKeeper session expired. Re-establishing connection... %v", err)
 	}
 
-	otel.SetTracerProvider(
-		sdktrace.NewTracerProvider(
-			sdktrace.WithSampler(sdktrace.AlwaysSample()),
-			sdktrace.WithBatcher(exporter),
-			sdktrace.WithResource(resources),
-		),
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resources),
 	)
-	return exporter.Shutdown
+	otel.SetTracerProvider(tracerProvider)
+
+	// Shutting down the provider flushes the spans still batched before it shuts the exporter down
+	return tracerProvider.Shutdown
 }
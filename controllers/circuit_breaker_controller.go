@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"schedulerV2/services"
+	"schedulerV2/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetCircuitBreakers(c *gin.Context) {
+	breakers, err := services.GetCircuitBreakers()
+	if err != nil {
+		utils.ErrorResponse(c, nil, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch circuit breakers:- %s", err.Error()))
+		return
+	}
+	utils.SuccessResponse(c, breakers, utils.SuccessMessage)
+}
+
+func ResetCircuitBreaker(c *gin.Context) {
+	host := c.Param("host")
+	found, err := services.ResetCircuitBreaker(host)
+	if err != nil {
+		utils.ErrorResponse(c, nil, http.StatusInternalServerError, fmt.Sprintf("Failed to reset circuit breaker:- %s", err.Error()))
+		return
+	}
+	if !found {
+		utils.ErrorResponse(c, nil, http.StatusNotFound, fmt.Sprintf("No circuit breaker found for host %s", host))
+		return
+	}
+	utils.SuccessResponse(c, fmt.Sprintf("Circuit breaker for host %s is successfully reset", host), utils.SuccessMessage)
+}
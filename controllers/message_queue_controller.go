@@ -6,6 +6,7 @@ import (
 	"schedulerV2/models"
 	"schedulerV2/services"
 	"schedulerV2/utils"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
@@ -25,6 +26,7 @@ func EnqueueMessage(c *gin.Context) {
 	}
 
 	// Extract serviceName from claims and assign it to the message queue object
+	var tokenService string
 	if claims, exists := c.Get("claims"); exists {
 		if claimsMap, ok := claims.(jwt.MapClaims); ok {
 			serviceName, foundService := claimsMap["serviceName"]
@@ -35,9 +37,10 @@ func EnqueueMessage(c *gin.Context) {
 				return
 			}
 
+			tokenService = fmt.Sprintf("%v", serviceName)
 			// Set the serviceName from token if not present in request body
 			if messageRequest.ServiceName == "" {
-				mq.ServiceName = fmt.Sprintf("%v", serviceName)
+				mq.ServiceName = tokenService
 			} else {
 				// Override with the serviceName from request body
 				mq.ServiceName = messageRequest.ServiceName
@@ -46,10 +49,51 @@ func EnqueueMessage(c *gin.Context) {
 		}
 	}
 
-	id, err := services.EnqueueMessage(mq)
+	id, outcome, err := services.EnqueueMessage(c.Request.Context(), mq, tokenService)
 	if err != nil {
 		utils.ErrorResponse(c, nil, http.StatusBadRequest, fmt.Sprintf("Failed to push the message:- %s", err.Error()))
 		return
 	}
-	utils.SuccessResponse(c, fmt.Sprintf("Message with id %d is successfully pushed", id), utils.SuccessMessage)
+
+	switch outcome {
+	case models.DEBOUNCED:
+		utils.SuccessResponse(c, fmt.Sprintf("Message with id %d is successfully debounced", id), utils.SuccessMessage)
+	case models.THROTTLED:
+		utils.SuccessResponse(c, fmt.Sprintf("Message dropped by throttle, message with id %d is already pending", id), utils.SuccessMessage)
+	default:
+		utils.SuccessResponse(c, fmt.Sprintf("Message with id %d is successfully pushed", id), utils.SuccessMessage)
+	}
+}
+
+// GetMessageResult returns the stored callback result of a message of the service of the token
+func GetMessageResult(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		utils.ErrorResponse(c, nil, http.StatusBadRequest, fmt.Sprintf("Invalid message id %s", c.Param("id")))
+		return
+	}
+
+	var serviceName string
+	if claims, exists := c.Get("claims"); exists {
+		if claimsMap, ok := claims.(jwt.MapClaims); ok {
+			if tokenService, found := claimsMap["serviceName"]; found {
+				serviceName = fmt.Sprintf("%v", tokenService)
+			}
+		}
+	}
+	if serviceName == "" {
+		utils.ErrorResponse(c, nil, http.StatusUnauthorized, "Invalid/Malformed Token")
+		return
+	}
+
+	result, found, err := services.GetMessageResult(serviceName, uint(id))
+	if err != nil {
+		utils.ErrorResponse(c, nil, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch the message result:- %s", err.Error()))
+		return
+	}
+	if !found {
+		utils.ErrorResponse(c, nil, http.StatusNotFound, fmt.Sprintf("No message found with id %d", id))
+		return
+	}
+	utils.SuccessResponse(c, result, utils.SuccessMessage)
 }
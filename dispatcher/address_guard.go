@@ -0,0 +1,98 @@
+package dispatcher
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// blockedRanges are the non-public ranges that the net.IP helpers do not cover
+var blockedRanges = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+)
+
+// BlockedAddressError is returned when a callback connects to an address the guard does not allow
+type BlockedAddressError struct {
+	Address string
+}
+
+func (e *BlockedAddressError) Error() string {
+	return fmt.Sprintf("callback address %s is not allowed", e.Address)
+}
+
+// AddressGuard rejects connections to private, loopback, link-local and other non-public addresses unless they fall
+// in an allowed range. It checks the address being dialed after resolution, so DNS rebinding cannot get around it.
+type AddressGuard struct {
+	allowed []*net.IPNet
+}
+
+// NewAddressGuard builds a guard that lets through the given CIDR ranges
+func NewAddressGuard(allowedCIDRs []string) (*AddressGuard, error) {
+	guard := &AddressGuard{}
+	for _, cidr := range allowedCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR %q: %v", cidr, err)
+		}
+		guard.allowed = append(guard.allowed, network)
+	}
+	return guard, nil
+}
+
+// Allowed reports whether callbacks may connect to ip
+func (g *AddressGuard) Allowed(ip net.IP) bool {
+	for _, network := range g.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range blockedRanges {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Control is a net.Dialer control function that aborts connections to addresses that are not allowed
+func (g *AddressGuard) Control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return &BlockedAddressError{Address: address}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !g.Allowed(ip) {
+		return &BlockedAddressError{Address: address}
+	}
+	return nil
+}
+
+// newDialer returns a dialer that checks every connection against the guard when it is not nil
+func newDialer(dialer *net.Dialer, guard *AddressGuard) *net.Dialer {
+	if guard != nil {
+		dialer.Control = guard.Control
+	}
+	return dialer
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,81 @@
+package dispatcher
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestAddressGuardAllowed(t *testing.T) {
+	guard, err := NewAddressGuard([]string{"10.20.0.0/16", "fd00:1::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"10.20.3.4", true},
+		{"172.16.5.5", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"198.18.0.1", false},
+		{"240.0.0.1", false},
+		{"224.0.0.1", false},
+		{"64:ff9b::7f00:1", false},
+		{"fd00::1", false},
+		{"fd00:1::1", true},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			if got := guard.Allowed(net.ParseIP(test.ip)); got != test.want {
+				t.Errorf("Allowed(%s) = %v, want %v", test.ip, got, test.want)
+			}
+		})
+	}
+}
+
+func TestAddressGuardControl(t *testing.T) {
+	guard, err := NewAddressGuard(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address string
+		blocked bool
+	}{
+		{"93.184.216.34:443", false},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", false},
+		{"127.0.0.1:80", true},
+		{"[::1]:80", true},
+		{"localhost:80", true},
+		{"93.184.216.34", true},
+	}
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			err := guard.Control("tcp", test.address, nil)
+			var blockedErr *BlockedAddressError
+			if blocked := errors.As(err, &blockedErr); blocked != test.blocked {
+				t.Errorf("Control(%s) = %v, want blocked %v", test.address, err, test.blocked)
+			}
+		})
+	}
+}
+
+func TestNewAddressGuardRejectsInvalidCIDR(t *testing.T) {
+	if _, err := NewAddressGuard([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("NewAddressGuard accepted an invalid CIDR")
+	}
+}
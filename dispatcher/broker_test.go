@@ -0,0 +1,100 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestBrokerDispatchers(t *testing.T) {
+	broker := NewMemoryBroker()
+	registry := NewRegistry()
+	registry.Register(NewNATSDispatcher(broker), "nats")
+	registry.Register(NewKafkaDispatcher(broker), "kafka")
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Scheduler-Signature", "t=1,v1=abc")
+	header.Add("X-Trace", "one")
+	header.Add("X-Trace", "two")
+	body := []byte(`{"id":42}`)
+
+	tests := []struct {
+		name        string
+		callbackUrl string
+		destination string
+		key         []byte
+	}{
+		{"nats subject as host", "nats://orders.created", "orders.created", nil},
+		{"nats subject as opaque", "nats:orders.updated", "orders.updated", nil},
+		{"kafka topic", "kafka://orders", "orders", nil},
+		{"kafka topic with key", "kafka://payments?key=user-7", "payments", []byte("user-7")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, err := url.Parse(test.callbackUrl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := registry.For(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := d.Dispatch(context.Background(), &Request{Method: http.MethodPost, Url: target, Header: header, Body: body})
+			if err != nil {
+				t.Fatalf("Dispatch: %v", err)
+			}
+			if !resp.NoReply || resp.StatusCode != http.StatusAccepted {
+				t.Errorf("response = %d, NoReply %v, want 202 without reply", resp.StatusCode, resp.NoReply)
+			}
+
+			published := broker.Messages(test.destination)
+			if len(published) != 1 {
+				t.Fatalf("%d messages published to %s, want 1", len(published), test.destination)
+			}
+			msg := published[0]
+			if string(msg.Body) != string(body) {
+				t.Errorf("payload = %s, want %s", msg.Body, body)
+			}
+			if string(msg.Key) != string(test.key) {
+				t.Errorf("key = %q, want %q", msg.Key, test.key)
+			}
+			for name, values := range header {
+				if got := msg.Header[name]; !reflect.DeepEqual(got, values) {
+					t.Errorf("header %s = %v, want %v", name, got, values)
+				}
+			}
+		})
+	}
+}
+
+func TestBrokerDispatchersErrors(t *testing.T) {
+	broker := NewMemoryBroker()
+	broker.Err = errors.New("broker unavailable")
+
+	tests := []struct {
+		name        string
+		dispatcher  Dispatcher
+		callbackUrl string
+	}{
+		{"nats without subject", NewNATSDispatcher(NewMemoryBroker()), "nats://"},
+		{"kafka without topic", NewKafkaDispatcher(NewMemoryBroker()), "kafka://"},
+		{"nats publish failure", NewNATSDispatcher(broker), "nats://orders"},
+		{"kafka write failure", NewKafkaDispatcher(broker), "kafka://orders"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, err := url.Parse(test.callbackUrl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := test.dispatcher.Dispatch(context.Background(), &Request{Url: target, Header: http.Header{}}); err == nil {
+				t.Error("Dispatch succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// MaxResponseBytes caps how much of a callback response body is read
+const MaxResponseBytes = 1 << 20
+
+// Request is a single callback delivery, independent of the transport
+type Request struct {
+	Method string
+	Url    *url.URL
+	Header http.Header
+	Body   []byte
+	// TLSProfile names the TLS profile used to reach the target, empty for the default settings
+	TLSProfile string
+	// ServiceName is the service the callback belongs to, used by the proxy rules
+	ServiceName string
+}
+
+// Response is the reply of a callback target
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// NoReply is set by sinks that do not answer, for which publishing the message counts as delivery
+	NoReply bool
+}
+
+// Dispatcher delivers callbacks for one or more URL schemes
+type Dispatcher interface {
+	Dispatch(ctx context.Context, req *Request) (*Response, error)
+}
+
+// Registry selects the dispatcher of a callback by its URL scheme
+type Registry struct {
+	mu          sync.RWMutex
+	dispatchers map[string]Dispatcher
+}
+
+func NewRegistry() *Registry {
+	return &Registry{dispatchers: make(map[string]Dispatcher)}
+}
+
+// Register makes the dispatcher handle callbacks with the given URL schemes
+func (r *Registry) Register(d Dispatcher, schemes ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, scheme := range schemes {
+		r.dispatchers[strings.ToLower(scheme)] = d
+	}
+}
+
+// For returns the dispatcher registered for the scheme of the callback URL
+func (r *Registry) For(callbackUrl *url.URL) (Dispatcher, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, found := r.dispatchers[strings.ToLower(callbackUrl.Scheme)]
+	if !found {
+		return nil, fmt.Errorf("no dispatcher registered for callback scheme %q", callbackUrl.Scheme)
+	}
+	return d, nil
+}
+
+// Close closes the registered dispatchers holding connections, once each even when registered for several schemes
+func (r *Registry) Close() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	closed := make(map[Dispatcher]bool)
+	var errs []error
+	for _, d := range r.dispatchers {
+		closer, ok := d.(io.Closer)
+		if !ok || closed[d] {
+			continue
+		}
+		closed[d] = true
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Supports reports whether a dispatcher is registered for the scheme of the callback URL
+func (r *Registry) Supports(callbackUrl string) bool {
+	parsed, err := url.Parse(callbackUrl)
+	if err != nil {
+		return false
+	}
+	_, err = r.For(parsed)
+	return err == nil
+}
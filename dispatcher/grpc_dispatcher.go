@@ -0,0 +1,239 @@
+package dispatcher
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"schedulerV2/models"
+	callbackv1 "schedulerV2/proto/scheduler/callback/v1"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+//go:generate protoc -I ../proto --go_out=../proto --go_opt=paths=source_relative scheduler/callback/v1/callback.proto
+
+// GRPCDispatcher invokes unary methods of callbacks addressed as grpc://host:port/package.Service/Method with the
+// scheduler.callback.v1 messages. The gRPC status is mapped onto the equivalent HTTP status, so the same outcome rules
+// apply as for HTTP callbacks.
+type GRPCDispatcher struct {
+	targets  map[string]models.GrpcTargetConfig
+	profiles map[string]*TLSProfile
+	guard    *AddressGuard
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func NewGRPCDispatcher(targets map[string]models.GrpcTargetConfig, profiles map[string]*TLSProfile, guard *AddressGuard) *GRPCDispatcher {
+	return &GRPCDispatcher{targets: targets, profiles: profiles, guard: guard, conns: make(map[string]*grpc.ClientConn)}
+}
+
+func (d *GRPCDispatcher) Dispatch(ctx context.Context, req *Request) (*Response, error) {
+	method := req.Url.Path
+	if req.Url.Host == "" || strings.Count(method, "/") != 2 {
+		return nil, fmt.Errorf("grpc callback URL %s must look like grpc://host:port/package.Service/Method", req.Url)
+	}
+
+	conn, err := d.conn(req.Url.Host, req.TLSProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := newCallbackRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	md := metadata.MD{}
+	for name, values := range req.Header {
+		if strings.EqualFold(name, "Content-Type") {
+			continue
+		}
+		md.Append(name, values...)
+	}
+
+	response := &callbackv1.CallbackResponse{}
+	var trailer metadata.MD
+	err = conn.Invoke(metadata.NewOutgoingContext(ctx, md), method, request, response, grpc.Trailer(&trailer))
+	if err != nil {
+		st, ok := status.FromError(err)
+		if !ok || ctx.Err() != nil {
+			return nil, err
+		}
+		header := http.Header{}
+		if retryAfter := trailer.Get("retry-after"); len(retryAfter) > 0 {
+			header.Set("Retry-After", retryAfter[0])
+		}
+		return &Response{StatusCode: httpStatusFromCode(st.Code()), Header: header, Body: []byte(st.Message())}, nil
+	}
+
+	body, err := callbackResponseBody(response)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: body}, nil
+}
+
+// conn returns the cached client connection of the target, created with the requested TLS profile or else the TLS
+// settings of the target
+func (d *GRPCDispatcher) conn(target string, profileName string) (*grpc.ClientConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cfg := d.targets[target]
+	if profileName == "" {
+		profileName = cfg.TLSProfile
+	}
+
+	key := target + "|" + profileName
+	if conn, found := d.conns[key]; found {
+		return conn, nil
+	}
+
+	var creds credentials.TransportCredentials
+	if profileName != "" {
+		profile, found := d.profiles[profileName]
+		if !found {
+			return nil, fmt.Errorf("unknown tls profile %s", profileName)
+		}
+		creds = credentials.NewTLS(profile.TLSConfig())
+	} else {
+		var err error
+		creds, err = transportCredentials(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS settings for grpc target %s: %v", target, err)
+		}
+	}
+
+	dialer := newDialer(&net.Dialer{}, d.guard)
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds), grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}))
+	if err != nil {
+		return nil, err
+	}
+	d.conns[key] = conn
+	return conn, nil
+}
+
+// Close closes the cached client connections, callbacks dispatched afterwards open new ones
+func (d *GRPCDispatcher) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var errs []error
+	for key, conn := range d.conns {
+		if err := conn.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing grpc connection to %s: %v", strings.SplitN(key, "|", 2)[0], err))
+		}
+		delete(d.conns, key)
+	}
+	return errors.Join(errs...)
+}
+
+func transportCredentials(cfg models.GrpcTargetConfig) (credentials.TransportCredentials, error) {
+	if !cfg.TLS {
+		return insecure.NewCredentials(), nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// newCallbackRequest transcodes the JSON body and headers into a CallbackRequest
+func newCallbackRequest(req *Request) (*callbackv1.CallbackRequest, error) {
+	var payload interface{}
+	if len(req.Body) > 0 {
+		if err := json.Unmarshal(req.Body, &payload); err != nil {
+			return nil, fmt.Errorf("error transcoding payload for grpc: %v", err)
+		}
+	}
+	value, err := structpb.NewValue(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error transcoding payload for grpc: %v", err)
+	}
+
+	request := &callbackv1.CallbackRequest{Payload: value, Metadata: make(map[string]string, len(req.Header))}
+	for name := range req.Header {
+		request.Metadata[name] = req.Header.Get(name)
+	}
+	return request, nil
+}
+
+// callbackResponseBody transcodes a CallbackResponse into the JSON callback response protocol
+func callbackResponseBody(response *callbackv1.CallbackResponse) ([]byte, error) {
+	data := models.Data{
+		Version:   int(response.GetVersion()),
+		Status:    response.GetStatus(),
+		Interval:  response.GetInterval(),
+		RetryAt:   response.GetRetryAt(),
+		NextRetry: response.GetNextRetry(),
+		Reason:    response.GetReason(),
+	}
+	if response.GetPayload() != nil {
+		payload, err := protojson.Marshal(response.GetPayload())
+		if err != nil {
+			return nil, fmt.Errorf("invalid grpc callback response payload: %v", err)
+		}
+		data.Payload = payload
+	}
+	return json.Marshal(models.CallbackResponseDTO{Data: data})
+}
+
+// httpStatusFromCode maps a gRPC status code onto the equivalent HTTP status. Transient codes map onto statuses that
+// the default outcome rules retry, while codes that cannot succeed on retry map onto non-retryable 4xx statuses.
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return http.StatusRequestTimeout
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound, codes.Unimplemented:
+		return http.StatusNotFound
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unavailable, codes.Aborted:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,198 @@
+package dispatcher
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	callbackv1 "schedulerV2/proto/scheduler/callback/v1"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var (
+	protoMessagePattern = regexp.MustCompile(`(?s)message (\w+) \{(.*?)\n\}`)
+	protoFieldPattern   = regexp.MustCompile(`(?m)^\s*[\w.<>, ]+? (\w+) = (\d+);`)
+)
+
+// TestCallbackProtoIsGenerated fails when callback.proto declares fields the generated code does not have, that is
+// when the file was changed without running go generate ./dispatcher
+func TestCallbackProtoIsGenerated(t *testing.T) {
+	source, err := os.ReadFile("../proto/scheduler/callback/v1/callback.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated := callbackv1.File_scheduler_callback_v1_callback_proto.Messages()
+
+	messages := protoMessagePattern.FindAllStringSubmatch(string(source), -1)
+	if len(messages) != generated.Len() {
+		t.Errorf("callback.proto declares %d messages, the generated code has %d", len(messages), generated.Len())
+	}
+	for _, message := range messages {
+		desc := generated.ByName(protoreflect.Name(message[1]))
+		if desc == nil {
+			t.Errorf("message %s is not generated", message[1])
+			continue
+		}
+		fields := protoFieldPattern.FindAllStringSubmatch(message[2], -1)
+		if len(fields) != desc.Fields().Len() {
+			t.Errorf("%s declares %d fields, the generated code has %d", message[1], len(fields), desc.Fields().Len())
+		}
+		for _, field := range fields {
+			fd := desc.Fields().ByName(protoreflect.Name(field[1]))
+			if fd == nil || strconv.Itoa(int(fd.Number())) != field[2] {
+				t.Errorf("field %s.%s = %s is not generated", message[1], field[1], field[2])
+			}
+		}
+	}
+}
+
+func TestNewCallbackRequest(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Request-Id", "abc")
+	header.Set("X-Service", "billing")
+	body := `{"id":42,"tags":["a","b"],"nested":{"ok":true}}`
+
+	request, err := newCallbackRequest(&Request{Header: header, Body: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadJSON, err := protojson.Marshal(request.GetPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalJSON(t, payloadJSON, []byte(body)) {
+		t.Errorf("payload = %s, want %s", payloadJSON, body)
+	}
+	if len(request.GetMetadata()) != len(header) {
+		t.Errorf("metadata has %d entries, want %d", len(request.GetMetadata()), len(header))
+	}
+	for name := range header {
+		if got := request.GetMetadata()[name]; got != header.Get(name) {
+			t.Errorf("metadata %s = %q, want %q", name, got, header.Get(name))
+		}
+	}
+}
+
+func TestCallbackResponseBody(t *testing.T) {
+	payload, err := structpb.NewStruct(map[string]interface{}{"cursor": "c-7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := callbackResponseBody(&callbackv1.CallbackResponse{
+		Version:   2,
+		Status:    "RETRY",
+		Interval:  30,
+		RetryAt:   1790000000,
+		NextRetry: 1790000060,
+		Payload:   payload,
+		Reason:    "busy",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"data":{"version":2,"status":"RETRY","interval":30,"retryAt":1790000000,"nextRetry":1790000060,"payload":{"cursor":"c-7"},"reason":"busy"}}`
+	if !equalJSON(t, got, []byte(want)) {
+		t.Errorf("decoded response = %s, want %s", got, want)
+	}
+}
+
+func TestGRPCDispatcherDispatch(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan *callbackv1.CallbackRequest, 1)
+	server := grpc.NewServer(grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		request := &callbackv1.CallbackRequest{}
+		if err := stream.RecvMsg(request); err != nil {
+			return err
+		}
+		requests <- request
+		return stream.SendMsg(&callbackv1.CallbackResponse{Status: "SUCCESS"})
+	}))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	d := NewGRPCDispatcher(nil, nil, nil)
+	defer d.Close()
+	header := http.Header{}
+	header.Set("X-Service", "billing")
+	target := &url.URL{Scheme: "grpc", Host: listener.Addr().String(), Path: "/test.Callback/Notify"}
+	resp, err := d.Dispatch(context.Background(), &Request{Url: target, Header: header, Body: []byte(`{"id":42}`)})
+	if err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+
+	request := <-requests
+	if id := request.GetPayload().GetStructValue().GetFields()["id"].GetNumberValue(); id != 42 {
+		t.Errorf("payload id = %v, want 42", id)
+	}
+	if got := request.GetMetadata()["X-Service"]; got != "billing" {
+		t.Errorf("metadata X-Service = %q, want billing", got)
+	}
+	if resp.StatusCode != http.StatusOK || !equalJSON(t, resp.Body, []byte(`{"data":{"status":"SUCCESS","interval":0}}`)) {
+		t.Errorf("response %d %s, want 200 with status SUCCESS", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestGRPCDispatcherClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	go server.Serve(listener)
+	defer server.Stop()
+
+	d := NewGRPCDispatcher(nil, nil, nil)
+	registry := NewRegistry()
+	registry.Register(d, "grpc")
+
+	target := &url.URL{Scheme: "grpc", Host: listener.Addr().String(), Path: "/test.Callback/Notify"}
+	if _, err := d.Dispatch(context.Background(), &Request{Url: target, Header: http.Header{}, Body: []byte(`{}`)}); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	d.mu.Lock()
+	conns := make([]*grpc.ClientConn, 0, len(d.conns))
+	for _, conn := range d.conns {
+		conns = append(conns, conn)
+	}
+	d.mu.Unlock()
+	if len(conns) != 1 {
+		t.Fatalf("%d cached connections, want 1", len(conns))
+	}
+
+	if err := registry.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if len(d.conns) != 0 {
+		t.Errorf("%d cached connections after Close, want none", len(d.conns))
+	}
+	if state := conns[0].GetState().String(); state != "SHUTDOWN" {
+		t.Errorf("connection state after Close = %s, want SHUTDOWN", state)
+	}
+}
+
+// equalJSON reports whether both documents hold the same JSON value
+func equalJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("invalid JSON %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b, err)
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return string(ja) == string(jb)
+}
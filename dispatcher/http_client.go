@@ -0,0 +1,131 @@
+package dispatcher
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"schedulerV2/models"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// NewHTTPClient builds a callback client shared by every dispatch, using tlsConfig, guard and proxies when they are not
+// nil. Without proxy rules the proxy is taken from the environment.
+// The client has no overall timeout, each request is bounded by the deadline of its context instead. Redirects are not
+// followed, the callback URL passed the allowlist of its service but the location of a redirect did not, the redirect
+// response is returned as the callback response instead.
+func NewHTTPClient(cfg *models.CallbackTransportConfig, tlsConfig *tls.Config, guard *AddressGuard, proxies *ProxyRules) *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if proxies != nil {
+		proxy = proxies.Proxy
+	}
+
+	direct := NewHTTPTransport(cfg, guard)
+	direct.TLSClientConfig = tlsConfig
+	var transport http.RoundTripper = direct
+	if guard == nil {
+		direct.Proxy = proxy
+	} else {
+		// The proxies are trusted configuration and are dialed without the guard, the target is checked instead
+		direct.Proxy = nil
+		proxied := NewHTTPTransport(cfg, nil)
+		proxied.TLSClientConfig = tlsConfig
+		proxied.Proxy = requireProxy(proxy)
+		transport = &proxyRouter{proxy: proxy, direct: direct, proxied: proxied, guard: guard, resolver: net.DefaultResolver}
+	}
+
+	return &http.Client{
+		Transport: otelhttp.NewTransport(NewMetricsRoundTripper(transport)),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// proxyRouter sends the requests that go direct over the guarded transport, and the ones that go through a proxy over
+// the unguarded one once the resolved addresses of their target passed the guard
+type proxyRouter struct {
+	proxy    func(*http.Request) (*url.URL, error)
+	direct   *http.Transport
+	proxied  *http.Transport
+	guard    *AddressGuard
+	resolver *net.Resolver
+}
+
+func (r *proxyRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxyUrl, err := r.proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if proxyUrl == nil {
+		return r.direct.RoundTrip(req)
+	}
+	if err := r.checkTarget(req.Context(), req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	return r.proxied.RoundTrip(req)
+}
+
+// checkTarget resolves the host of a proxied request and rejects it when any of its addresses is not allowed. The
+// proxy resolves the host again, a record changed in between is not caught.
+func (r *proxyRouter) checkTarget(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !r.guard.Allowed(ip) {
+			return &BlockedAddressError{Address: host}
+		}
+		return nil
+	}
+
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("error resolving callback host %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !r.guard.Allowed(addr.IP) {
+			return &BlockedAddressError{Address: host}
+		}
+	}
+	return nil
+}
+
+// requireProxy makes the unguarded transport fail rather than go direct if the proxy decision changed
+func requireProxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyUrl, err := proxy(req)
+		if err == nil && proxyUrl == nil {
+			return nil, fmt.Errorf("callback to %s lost its proxy", req.URL.Host)
+		}
+		return proxyUrl, err
+	}
+}
+
+// NewHTTPTransport builds a pooled transport tuned by the callback transport configuration. Every connection is
+// checked against guard when it is not nil.
+func NewHTTPTransport(cfg *models.CallbackTransportConfig, guard *AddressGuard) *http.Transport {
+	dialer := newDialer(&net.Dialer{
+		Timeout:   seconds(cfg.DialTimeout),
+		KeepAlive: seconds(cfg.KeepAlive),
+	}, guard)
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       seconds(cfg.IdleConnTimeout),
+		TLSHandshakeTimeout:   seconds(cfg.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: seconds(cfg.ResponseHeaderTimeout),
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     cfg.DisableKeepAlives,
+	}
+}
+
+func seconds(value int) time.Duration {
+	return time.Duration(value) * time.Second
+}
@@ -0,0 +1,84 @@
+package dispatcher
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"schedulerV2/models"
+	"testing"
+	"time"
+)
+
+// BenchmarkCallbackClient compares callback throughput of the shared transport with a new default client per
+// request, as callbacks used to be sent, over plain HTTP and over TLS with HTTP/2:
+//
+//	go test ./dispatcher -run '^$' -bench CallbackClient -benchtime 20000x
+func BenchmarkCallbackClient(b *testing.B) {
+	for _, useTLS := range []bool{false, true} {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"data":{"status":"SUCCESS"}}`))
+		}))
+		var serverTLS *tls.Config
+		protocol := "http"
+		if useTLS {
+			server.EnableHTTP2 = true
+			server.StartTLS()
+			serverTLS = server.Client().Transport.(*http.Transport).TLSClientConfig
+			protocol = "tls"
+		} else {
+			server.Start()
+		}
+
+		transport := NewHTTPTransport(&models.CallbackTransportConfig{
+			MaxIdleConns:        1000,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90,
+			KeepAlive:           30,
+			DialTimeout:         5,
+			TLSHandshakeTimeout: 5,
+			HTTP2:               true,
+		}, nil)
+		transport.TLSClientConfig = serverTLS
+		shared := &http.Client{Transport: NewMetricsRoundTripper(transport)}
+
+		perRequest := func() *http.Client {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.TLSClientConfig = serverTLS
+			return &http.Client{Transport: t, Timeout: 30 * time.Second}
+		}
+
+		b.Run(protocol+"/per_request_client", func(b *testing.B) {
+			benchmarkCallbacks(b, server.URL, perRequest)
+		})
+		b.Run(protocol+"/shared_client", func(b *testing.B) {
+			benchmarkCallbacks(b, server.URL, func() *http.Client { return shared })
+		})
+
+		transport.CloseIdleConnections()
+		server.Close()
+	}
+}
+
+// benchmarkCallbacks posts b.N callbacks from concurrent senders
+func benchmarkCallbacks(b *testing.B, url string, client func() *http.Client) {
+	body := []byte(`{"userId":"42","event":"profile_sync"}`)
+	b.SetParallelism(16)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client().Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package dispatcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"schedulerV2/models"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPClientRefusesRedirects(t *testing.T) {
+	var followed atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed.Store(true)
+	}))
+	defer target.Close()
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+"/elsewhere", http.StatusTemporaryRedirect)
+	}))
+	defer callback.Close()
+
+	client := NewHTTPClient(&models.CallbackTransportConfig{}, nil, nil, nil)
+	resp, err := client.Post(callback.URL+"/callback", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("status = %d, want the redirect response", resp.StatusCode)
+	}
+	if followed.Load() {
+		t.Error("redirect was followed")
+	}
+}
@@ -0,0 +1,63 @@
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"schedulerV2/models"
+)
+
+// HTTPDispatcher delivers callbacks to http and https URLs over a shared client, or over the client of the TLS profile
+// requested by the callback. Each profile has its own connection pool since connections carry the client certificate.
+type HTTPDispatcher struct {
+	Client         *http.Client
+	ProfileClients map[string]*http.Client
+}
+
+func NewHTTPDispatcher(cfg *models.CallbackTransportConfig, profiles map[string]*TLSProfile, guard *AddressGuard, proxies *ProxyRules) *HTTPDispatcher {
+	d := &HTTPDispatcher{
+		Client:         NewHTTPClient(cfg, nil, guard, proxies),
+		ProfileClients: make(map[string]*http.Client, len(profiles)),
+	}
+	for name, profile := range profiles {
+		d.ProfileClients[name] = NewHTTPClient(cfg, profile.TLSConfig(), guard, proxies)
+	}
+	return d
+}
+
+func (d *HTTPDispatcher) Dispatch(ctx context.Context, req *Request) (*Response, error) {
+	client := d.Client
+	if req.TLSProfile != "" {
+		profileClient, found := d.ProfileClients[req.TLSProfile]
+		if !found {
+			return nil, fmt.Errorf("unknown tls profile %s", req.TLSProfile)
+		}
+		client = profileClient
+	}
+
+	var body io.Reader
+	if req.Body != nil {
+		body = bytes.NewReader(req.Body)
+	}
+
+	httpReq, err := http.NewRequestWithContext(withServiceName(ctx, req.ServiceName), req.Method, req.Url.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header = req.Header.Clone()
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(io.LimitReader(resp.Body, MaxResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error reading callback response: %v", err)
+	}
+
+	return &Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: responseBody}, nil
+}
@@ -0,0 +1,59 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaWriter is the part of *kafka.Writer used by the Kafka sink, so that an in-process stand-in can replace the brokers
+type KafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// KafkaDispatcher publishes callbacks addressed as kafka://topic onto Kafka. The write is acknowledged by the brokers
+// before it counts as delivered. An optional key query parameter sets the message key.
+type KafkaDispatcher struct {
+	Writer KafkaWriter
+}
+
+func NewKafkaDispatcher(writer KafkaWriter) *KafkaDispatcher {
+	return &KafkaDispatcher{Writer: writer}
+}
+
+// NewKafkaWriter returns a writer for the brokers that waits for all in-sync replicas to acknowledge each write
+func NewKafkaWriter(brokers []string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}
+}
+
+func (d *KafkaDispatcher) Dispatch(ctx context.Context, req *Request) (*Response, error) {
+	topic := req.Url.Host
+	if topic == "" {
+		topic = req.Url.Opaque
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("kafka callback URL %s has no topic", req.Url)
+	}
+
+	msg := kafka.Message{Topic: topic, Value: req.Body}
+	if key := req.Url.Query().Get("key"); key != "" {
+		msg.Key = []byte(key)
+	}
+	for name, values := range req.Header {
+		for _, value := range values {
+			msg.Headers = append(msg.Headers, kafka.Header{Key: name, Value: []byte(value)})
+		}
+	}
+
+	if err := d.Writer.WriteMessages(ctx, msg); err != nil {
+		return nil, fmt.Errorf("error publishing to kafka topic %s: %w", topic, err)
+	}
+
+	return &Response{StatusCode: http.StatusAccepted, NoReply: true}, nil
+}
@@ -0,0 +1,71 @@
+package dispatcher
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// PublishedMessage is a message captured by the MemoryBroker
+type PublishedMessage struct {
+	Destination string
+	Key         []byte
+	Body        []byte
+	Header      map[string][]string
+}
+
+// MemoryBroker is an in-process stand-in for NATS and Kafka. It implements NATSPublisher and KafkaWriter and keeps
+// every published message, so the sinks can run without a broker in local environments and tests.
+type MemoryBroker struct {
+	mu       sync.Mutex
+	messages map[string][]PublishedMessage
+	// Err, when set, is returned by every publish to simulate an unavailable broker
+	Err error
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{messages: make(map[string][]PublishedMessage)}
+}
+
+func (b *MemoryBroker) PublishMsg(msg *nats.Msg) error {
+	return b.publish(PublishedMessage{Destination: msg.Subject, Body: msg.Data, Header: msg.Header})
+}
+
+func (b *MemoryBroker) FlushWithContext(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (b *MemoryBroker) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		header := make(map[string][]string)
+		for _, h := range msg.Headers {
+			header[h.Key] = append(header[h.Key], string(h.Value))
+		}
+		if err := b.publish(PublishedMessage{Destination: msg.Topic, Key: msg.Key, Body: msg.Value, Header: header}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Messages returns the messages published to the subject or topic
+func (b *MemoryBroker) Messages(destination string) []PublishedMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]PublishedMessage(nil), b.messages[destination]...)
+}
+
+func (b *MemoryBroker) publish(msg PublishedMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Err != nil {
+		return b.Err
+	}
+	b.messages[msg.Destination] = append(b.messages[msg.Destination], msg)
+	return nil
+}
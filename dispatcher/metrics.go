@@ -0,0 +1,80 @@
+package dispatcher
+
+import (
+	"crypto/tls"
+	"expvar"
+	"net/http"
+	"net/http/httptrace"
+)
+
+// Connection level metrics of the callback transport, published with expvar under "callback_http"
+var (
+	httpMetrics = expvar.NewMap("callback_http")
+
+	requestsTotal      = new(expvar.Int)
+	requestsInFlight   = new(expvar.Int)
+	requestErrors      = new(expvar.Int)
+	connsNew           = new(expvar.Int)
+	connsReused        = new(expvar.Int)
+	connsWasIdle       = new(expvar.Int)
+	dialErrors         = new(expvar.Int)
+	tlsHandshakes      = new(expvar.Int)
+	tlsHandshakeErrors = new(expvar.Int)
+)
+
+func init() {
+	httpMetrics.Set("requests_total", requestsTotal)
+	httpMetrics.Set("requests_in_flight", requestsInFlight)
+	httpMetrics.Set("request_errors", requestErrors)
+	httpMetrics.Set("conns_new", connsNew)
+	httpMetrics.Set("conns_reused", connsReused)
+	httpMetrics.Set("conns_was_idle", connsWasIdle)
+	httpMetrics.Set("dial_errors", dialErrors)
+	httpMetrics.Set("tls_handshakes", tlsHandshakes)
+	httpMetrics.Set("tls_handshake_errors", tlsHandshakeErrors)
+}
+
+// metricsRoundTripper records connection reuse, dials and TLS handshakes of every request
+type metricsRoundTripper struct {
+	next http.RoundTripper
+}
+
+func NewMetricsRoundTripper(next http.RoundTripper) http.RoundTripper {
+	return &metricsRoundTripper{next: next}
+}
+
+func (m *metricsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				connsReused.Add(1)
+			} else {
+				connsNew.Add(1)
+			}
+			if info.WasIdle {
+				connsWasIdle.Add(1)
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				dialErrors.Add(1)
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			tlsHandshakes.Add(1)
+			if err != nil {
+				tlsHandshakeErrors.Add(1)
+			}
+		},
+	}
+
+	requestsTotal.Add(1)
+	requestsInFlight.Add(1)
+	defer requestsInFlight.Add(-1)
+
+	resp, err := m.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		requestErrors.Add(1)
+	}
+	return resp, err
+}
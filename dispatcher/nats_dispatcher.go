@@ -0,0 +1,52 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSPublisher is the part of *nats.Conn used by the NATS sink, so that an in-process stand-in can replace the server
+type NATSPublisher interface {
+	PublishMsg(msg *nats.Msg) error
+	FlushWithContext(ctx context.Context) error
+}
+
+// NATSDispatcher publishes callbacks addressed as nats://subject onto NATS. The publish is flushed to the server
+// before it counts as delivered.
+type NATSDispatcher struct {
+	Publisher NATSPublisher
+}
+
+func NewNATSDispatcher(publisher NATSPublisher) *NATSDispatcher {
+	return &NATSDispatcher{Publisher: publisher}
+}
+
+func (d *NATSDispatcher) Dispatch(ctx context.Context, req *Request) (*Response, error) {
+	subject := req.Url.Host
+	if subject == "" {
+		subject = req.Url.Opaque
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("nats callback URL %s has no subject", req.Url)
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = req.Body
+	for name, values := range req.Header {
+		for _, value := range values {
+			msg.Header.Add(name, value)
+		}
+	}
+
+	if err := d.Publisher.PublishMsg(msg); err != nil {
+		return nil, fmt.Errorf("error publishing to nats subject %s: %w", subject, err)
+	}
+	if err := d.Publisher.FlushWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("error flushing nats publish to subject %s: %w", subject, err)
+	}
+
+	return &Response{StatusCode: http.StatusAccepted, NoReply: true}, nil
+}
@@ -0,0 +1,161 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"schedulerV2/models"
+	"strings"
+)
+
+type serviceNameKey struct{}
+
+// ProxyRules picks the outbound proxy of http callbacks from the configured rules. Hosts in NoProxy always go direct,
+// otherwise the first rule matching the host and service of the callback decides.
+type ProxyRules struct {
+	rules           []proxyRule
+	noProxy         []string
+	fromEnvironment bool
+}
+
+type proxyRule struct {
+	hosts    []string
+	services []string
+	// proxy is nil for rules that send matching callbacks direct
+	proxy *url.URL
+}
+
+// NewProxyRules validates the proxy configuration and builds the rules
+func NewProxyRules(cfg *models.CallbackProxyConfig) (*ProxyRules, error) {
+	p := &ProxyRules{noProxy: cfg.NoProxy, fromEnvironment: cfg.FromEnvironment}
+	for i, ruleCfg := range cfg.Rules {
+		rule := proxyRule{hosts: ruleCfg.Hosts, services: ruleCfg.Services}
+		if ruleCfg.Url != "" {
+			proxyUrl, err := url.Parse(ruleCfg.Url)
+			if err != nil || proxyUrl.Host == "" {
+				return nil, fmt.Errorf("proxy rule %d has an invalid url", i)
+			}
+			if proxyUrl.Scheme != "http" && proxyUrl.Scheme != "https" {
+				return nil, fmt.Errorf("proxy rule %d has unsupported scheme %q", i, proxyUrl.Scheme)
+			}
+			if ruleCfg.Username != "" {
+				proxyUrl.User = url.UserPassword(ruleCfg.Username, ruleCfg.Password)
+			}
+			rule.proxy = proxyUrl
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// Proxy is an http.Transport proxy function
+func (p *ProxyRules) Proxy(req *http.Request) (*url.URL, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	for _, entry := range p.noProxy {
+		if matchNoProxy(entry, host, port) {
+			return nil, nil
+		}
+	}
+
+	serviceName, _ := req.Context().Value(serviceNameKey{}).(string)
+	for _, rule := range p.rules {
+		if rule.matches(host, port, serviceName) {
+			return rule.proxy, nil
+		}
+	}
+
+	if p.fromEnvironment {
+		return http.ProxyFromEnvironment(req)
+	}
+	return nil, nil
+}
+
+func (r proxyRule) matches(host, port, serviceName string) bool {
+	if len(r.services) > 0 && !contains(r.services, serviceName) {
+		return false
+	}
+	if len(r.hosts) == 0 {
+		return true
+	}
+	for _, pattern := range r.hosts {
+		if MatchHost(pattern, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchHost matches a host pattern with an optional port against a host and port.
+// *.example.com matches the subdomains of example.com but not example.com itself.
+func MatchHost(pattern, host, port string) bool {
+	patternHost, patternPort := pattern, ""
+	if h, p, err := net.SplitHostPort(pattern); err == nil {
+		patternHost, patternPort = h, p
+	}
+	if patternPort != "" && patternPort != port {
+		return false
+	}
+
+	host = strings.ToLower(host)
+	patternHost = strings.ToLower(patternHost)
+	if suffix, found := strings.CutPrefix(patternHost, "*."); found {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == patternHost
+}
+
+// matchNoProxy follows the NO_PROXY conventions: * matches every host, IPs and CIDRs match addresses, and a domain,
+// with or without a leading dot, matches itself and its subdomains. Entries may carry a port.
+func matchNoProxy(entry, host, port string) bool {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if entry == "" {
+		return false
+	}
+	if entry == "*" {
+		return true
+	}
+
+	if _, network, err := net.ParseCIDR(entry); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && network.Contains(ip)
+	}
+
+	entryHost, entryPort := entry, ""
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		entryHost, entryPort = h, p
+	}
+	if entryPort != "" && entryPort != port {
+		return false
+	}
+
+	if ip := net.ParseIP(entryHost); ip != nil {
+		return ip.Equal(net.ParseIP(host))
+	}
+
+	domain := strings.TrimPrefix(entryHost, ".")
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// withServiceName records the service of the callback for the proxy rules
+func withServiceName(ctx context.Context, serviceName string) context.Context {
+	return context.WithValue(ctx, serviceNameKey{}, serviceName)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package dispatcher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"schedulerV2/models"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval is how often the profile files are checked for changes
+const tlsReloadInterval = 30 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSProfile is a named outbound TLS configuration. The client certificate and CA bundle are reloaded from disk when
+// their files change, so rotated certificates are picked up without a restart.
+type TLSProfile struct {
+	Name string
+	cfg  models.TLSProfileConfig
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+// LoadTLSProfiles loads every configured profile, failing on unreadable or invalid files
+func LoadTLSProfiles(cfgs map[string]models.TLSProfileConfig) (map[string]*TLSProfile, error) {
+	profiles := make(map[string]*TLSProfile, len(cfgs))
+	for name, cfg := range cfgs {
+		if _, found := tlsVersions[cfg.MinVersion]; !found {
+			return nil, fmt.Errorf("tls profile %s has invalid min_version %q", name, cfg.MinVersion)
+		}
+		if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+			return nil, fmt.Errorf("tls profile %s needs both cert_file and key_file", name)
+		}
+
+		profile := &TLSProfile{Name: name, cfg: cfg, modTimes: make(map[string]time.Time)}
+		if err := profile.load(); err != nil {
+			return nil, fmt.Errorf("tls profile %s: %v", name, err)
+		}
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// TLSConfig returns a client TLS config that always uses the latest certificate and CA bundle of the profile
+func (p *TLSProfile) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tlsVersions[p.cfg.MinVersion],
+		ServerName: p.cfg.ServerName,
+	}
+
+	if p.cfg.CertFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			p.reloadIfChanged()
+			p.mu.RLock()
+			defer p.mu.RUnlock()
+			return p.cert, nil
+		}
+	}
+
+	// The CA bundle can change at runtime, so the server chain is verified against the current pool here instead of
+	// the static RootCAs
+	if p.cfg.CAFile != "" {
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			p.reloadIfChanged()
+			p.mu.RLock()
+			pool := p.pool
+			p.mu.RUnlock()
+
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("tls profile %s: server presented no certificate", p.Name)
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			serverName := p.cfg.ServerName
+			if serverName == "" {
+				serverName = state.ServerName
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       serverName,
+				Roots:         pool,
+				Intermediates: intermediates,
+			})
+			return err
+		}
+	}
+	return config
+}
+
+func (p *TLSProfile) reloadIfChanged() {
+	p.mu.RLock()
+	due := time.Since(p.lastCheck) >= tlsReloadInterval
+	p.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	p.mu.Lock()
+	changed := false
+	for _, file := range []string{p.cfg.CertFile, p.cfg.KeyFile, p.cfg.CAFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil && !info.ModTime().Equal(p.modTimes[file]) {
+			changed = true
+		}
+	}
+	p.lastCheck = time.Now()
+	p.mu.Unlock()
+
+	if changed {
+		// A failed reload keeps serving the previous certificate and CA bundle
+		_ = p.load()
+	}
+}
+
+func (p *TLSProfile) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{p.cfg.CertFile, p.cfg.KeyFile, p.cfg.CAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if p.cfg.CertFile != "" {
+		loaded, err := tls.LoadX509KeyPair(p.cfg.CertFile, p.cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &loaded
+	}
+
+	var pool *x509.CertPool
+	if p.cfg.CAFile != "" {
+		pem, err := os.ReadFile(p.cfg.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", p.cfg.CAFile)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cert = cert
+	p.pool = pool
+	p.modTimes = modTimes
+	p.lastCheck = time.Now()
+	return nil
+}
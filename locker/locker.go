@@ -0,0 +1,20 @@
+package locker
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotHeld is returned when releasing or refreshing a lock the locker does not hold, including a lock lost with
+// its ZooKeeper session or database connection
+var ErrNotHeld = errors.New("lock is not held")
+
+// Locker takes named, non blocking, non reentrant locks shared by all replicas using the same backend
+type Locker interface {
+	// TryAcquire takes the lock and reports false without waiting when it is held, by this locker or another
+	TryAcquire(ctx context.Context, name string) (bool, error)
+	// Release gives up a lock taken with TryAcquire
+	Release(ctx context.Context, name string) error
+	// Refresh checks that the lock is still held, returning ErrNotHeld when it was lost
+	Refresh(ctx context.Context, name string) error
+}
@@ -0,0 +1,25 @@
+package locker_test
+
+import (
+	"context"
+	"schedulerV2/locker"
+	"schedulerV2/locker/lockertest"
+	"testing"
+	"time"
+)
+
+// runConformance runs the lockertest suite with lockers from newLocker, one subtest per case
+func runConformance(t *testing.T, newLocker func() locker.Locker) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for _, result := range lockertest.Run(ctx, newLocker) {
+		result := result
+		t.Run(result.Name, func(t *testing.T) {
+			if result.Err != nil {
+				t.Error(result.Err)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Package lockertest is the conformance suite of locker.Locker, every backend must pass it. The locker tests run it
+// against each backend.
+package lockertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"schedulerV2/locker"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Case is one behaviour every locker must have. a and b are the lockers of two replicas, and key is a lock name no
+// other case uses.
+type Case struct {
+	Name string
+	Run  func(ctx context.Context, a, b locker.Locker, key string) error
+}
+
+// Result is the outcome of a case, Err is nil when it passed
+type Result struct {
+	Name string
+	Err  error
+}
+
+var Cases = []Case{
+	{"acquire and release", acquireAndRelease},
+	{"not reentrant", notReentrant},
+	{"exclusive across replicas", exclusiveAcrossReplicas},
+	{"release of a lock not held", releaseNotHeld},
+	{"refresh", refresh},
+	{"independent names", independentNames},
+	{"cancelled context", cancelledContext},
+	{"single winner under contention", singleWinner},
+}
+
+// Run runs every case with two fresh lockers from newLocker. Backends scoped to a process, like the memory locker,
+// may return the same locker for both replicas. Lockers implementing io.Closer are closed after the case.
+func Run(ctx context.Context, newLocker func() locker.Locker) []Result {
+	prefix := "lockertest-" + uuid.NewString()[:8]
+	results := make([]Result, 0, len(Cases))
+	for i, c := range Cases {
+		a, b := newLocker(), newLocker()
+		err := c.Run(ctx, a, b, fmt.Sprintf("%s-%d", prefix, i))
+		closeLocker(a)
+		if b != a {
+			closeLocker(b)
+		}
+		results = append(results, Result{Name: c.Name, Err: err})
+	}
+	return results
+}
+
+func closeLocker(l locker.Locker) {
+	if closer, ok := l.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func acquireAndRelease(ctx context.Context, a, b locker.Locker, key string) error {
+	for round := 1; round <= 2; round++ {
+		if err := expectAcquire(ctx, a, key, true); err != nil {
+			return fmt.Errorf("round %d: %v", round, err)
+		}
+		if err := a.Release(ctx, key); err != nil {
+			return fmt.Errorf("round %d: release: %v", round, err)
+		}
+	}
+	return nil
+}
+
+func notReentrant(ctx context.Context, a, b locker.Locker, key string) error {
+	if err := expectAcquire(ctx, a, key, true); err != nil {
+		return err
+	}
+	defer a.Release(ctx, key)
+	return expectAcquire(ctx, a, key, false)
+}
+
+func exclusiveAcrossReplicas(ctx context.Context, a, b locker.Locker, key string) error {
+	if err := expectAcquire(ctx, a, key, true); err != nil {
+		return err
+	}
+	if err := expectAcquire(ctx, b, key, false); err != nil {
+		a.Release(ctx, key)
+		return err
+	}
+	if err := a.Release(ctx, key); err != nil {
+		return fmt.Errorf("release: %v", err)
+	}
+	if err := expectAcquire(ctx, b, key, true); err != nil {
+		return fmt.Errorf("after release: %v", err)
+	}
+	return b.Release(ctx, key)
+}
+
+func releaseNotHeld(ctx context.Context, a, b locker.Locker, key string) error {
+	if err := a.Release(ctx, key); !errors.Is(err, locker.ErrNotHeld) {
+		return fmt.Errorf("release before acquire: want ErrNotHeld, got %v", err)
+	}
+	if a == b {
+		return nil
+	}
+
+	if err := expectAcquire(ctx, a, key, true); err != nil {
+		return err
+	}
+	defer a.Release(ctx, key)
+	if err := b.Release(ctx, key); !errors.Is(err, locker.ErrNotHeld) {
+		return fmt.Errorf("release by the other replica: want ErrNotHeld, got %v", err)
+	}
+	if err := a.Refresh(ctx, key); err != nil {
+		return fmt.Errorf("lock lost after release by the other replica: %v", err)
+	}
+	return nil
+}
+
+func refresh(ctx context.Context, a, b locker.Locker, key string) error {
+	if err := a.Refresh(ctx, key); !errors.Is(err, locker.ErrNotHeld) {
+		return fmt.Errorf("refresh before acquire: want ErrNotHeld, got %v", err)
+	}
+	if err := expectAcquire(ctx, a, key, true); err != nil {
+		return err
+	}
+	if err := a.Refresh(ctx, key); err != nil {
+		a.Release(ctx, key)
+		return fmt.Errorf("refresh of a held lock: %v", err)
+	}
+	if err := a.Release(ctx, key); err != nil {
+		return fmt.Errorf("release: %v", err)
+	}
+	if err := a.Refresh(ctx, key); !errors.Is(err, locker.ErrNotHeld) {
+		return fmt.Errorf("refresh after release: want ErrNotHeld, got %v", err)
+	}
+	return nil
+}
+
+func independentNames(ctx context.Context, a, b locker.Locker, key string) error {
+	if err := expectAcquire(ctx, a, key+"-a", true); err != nil {
+		return err
+	}
+	defer a.Release(ctx, key+"-a")
+	if err := expectAcquire(ctx, b, key+"-b", true); err != nil {
+		return err
+	}
+	return b.Release(ctx, key+"-b")
+}
+
+func cancelledContext(ctx context.Context, a, b locker.Locker, key string) error {
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if acquired, err := a.TryAcquire(cancelled, key); err == nil {
+		if acquired {
+			a.Release(ctx, key)
+		}
+		return fmt.Errorf("acquire with a cancelled context: want an error, got none")
+	}
+	if err := expectAcquire(ctx, b, key, true); err != nil {
+		return fmt.Errorf("after the cancelled acquire: %v", err)
+	}
+	return b.Release(ctx, key)
+}
+
+func singleWinner(ctx context.Context, a, b locker.Locker, key string) error {
+	const contenders = 16
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var winners []locker.Locker
+	var errs []error
+
+	for i := 0; i < contenders; i++ {
+		l := a
+		if i%2 == 1 {
+			l = b
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acquired, err := l.TryAcquire(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+			} else if acquired {
+				winners = append(winners, l)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, winner := range winners {
+		winner.Release(ctx, key)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("acquire: %v", errs[0])
+	}
+	if len(winners) != 1 {
+		return fmt.Errorf("want 1 winner, got %d", len(winners))
+	}
+	return nil
+}
+
+func expectAcquire(ctx context.Context, l locker.Locker, key string, want bool) error {
+	acquired, err := l.TryAcquire(ctx, key)
+	if err != nil {
+		return fmt.Errorf("acquire: %v", err)
+	}
+	if acquired != want {
+		if acquired {
+			l.Release(ctx, key)
+		}
+		return fmt.Errorf("acquire: want %v, got %v", want, acquired)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package locker
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryLocker keeps locks in process, for single node deployments and local runs. Replicas do not see each other's
+// locks, so it must not be used with more than one replica.
+type MemoryLocker struct {
+	mu   sync.Mutex
+	held map[string]struct{}
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{held: make(map[string]struct{})}
+}
+
+func (l *MemoryLocker) TryAcquire(ctx context.Context, name string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.held[name]; found {
+		return false, nil
+	}
+	l.held[name] = struct{}{}
+	return true, nil
+}
+
+func (l *MemoryLocker) Release(ctx context.Context, name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.held[name]; !found {
+		return ErrNotHeld
+	}
+	delete(l.held, name)
+	return nil
+}
+
+func (l *MemoryLocker) Refresh(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.held[name]; !found {
+		return ErrNotHeld
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package locker_test
+
+import (
+	"schedulerV2/locker"
+	"testing"
+)
+
+func TestMemoryLocker(t *testing.T) {
+	// The memory locker is scoped to the process, both replicas share it
+	shared := locker.NewMemoryLocker()
+	runConformance(t, func() locker.Locker { return shared })
+}
@@ -0,0 +1,181 @@
+package locker
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"sync"
+)
+
+// DefaultPostgresSessions is the no of dedicated connections of a PostgresLocker when none is configured
+const DefaultPostgresSessions = 4
+
+// PostgresLocker takes locks with pg_try_advisory_lock. Advisory locks belong to the database session, so the locks
+// are held on a small pool of dedicated connections rather than one connection per lock, each name always going to the
+// same connection. A connection serves one lock query at a time, so the pool size bounds the lock queries in flight;
+// when a connection is lost its locks are gone and the next TryAcquire on it opens a new one.
+type PostgresLocker struct {
+	// db returns the current pool, it is replaced when the database credentials are refreshed
+	db       func() (*sql.DB, error)
+	sessions []*postgresSession
+}
+
+// postgresSession is a dedicated connection and the locks held on it
+type postgresSession struct {
+	mu   sync.Mutex
+	conn *sql.Conn
+	held map[string]int64
+}
+
+// NewPostgresLocker returns a locker holding its locks on up to sessions connections, DefaultPostgresSessions when
+// sessions is not positive
+func NewPostgresLocker(db func() (*sql.DB, error), sessions int) *PostgresLocker {
+	if sessions <= 0 {
+		sessions = DefaultPostgresSessions
+	}
+	l := &PostgresLocker{db: db, sessions: make([]*postgresSession, sessions)}
+	for i := range l.sessions {
+		l.sessions[i] = &postgresSession{held: make(map[string]int64)}
+	}
+	return l
+}
+
+func (l *PostgresLocker) TryAcquire(ctx context.Context, name string) (bool, error) {
+	key := advisoryKey(name)
+	s := l.session(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.held[name]; found {
+		// Advisory locks are reentrant within a session, the locker is not
+		return false, nil
+	}
+
+	conn, err := s.open(ctx, l.db)
+	if err != nil {
+		return false, err
+	}
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+		s.drop()
+		return false, err
+	}
+	if acquired {
+		s.held[name] = key
+	}
+	return acquired, nil
+}
+
+func (l *PostgresLocker) Release(ctx context.Context, name string) error {
+	s := l.session(advisoryKey(name))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, found := s.held[name]
+	if !found {
+		return ErrNotHeld
+	}
+	delete(s.held, name)
+
+	var released bool
+	if err := s.conn.QueryRowContext(ctx, "SELECT pg_advisory_unlock($1)", key).Scan(&released); err != nil {
+		s.drop()
+		return err
+	}
+	if !released {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// Refresh checks pg_locks for the advisory lock of the session, a bigint key is split over classid and objid
+func (l *PostgresLocker) Refresh(ctx context.Context, name string) error {
+	s := l.session(advisoryKey(name))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, found := s.held[name]
+	if !found {
+		return ErrNotHeld
+	}
+
+	var held bool
+	err := s.conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_locks
+		WHERE locktype = 'advisory' AND pid = pg_backend_pid() AND granted AND classid = $1 AND objid = $2 AND objsubid = 1)`,
+		int64(uint32(uint64(key)>>32)), int64(uint32(key))).Scan(&held)
+	if err != nil {
+		s.drop()
+		return err
+	}
+	if !held {
+		delete(s.held, name)
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// session returns the session the lock key belongs to
+func (l *PostgresLocker) session(key int64) *postgresSession {
+	return l.sessions[uint64(key)%uint64(len(l.sessions))]
+}
+
+// open returns the connection of the session, opening it when needed
+func (s *postgresSession) open(ctx context.Context, db func() (*sql.DB, error)) (*sql.Conn, error) {
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	pool, err := db()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// drop closes the connection after a failed query unless it is still alive, the locks it held are released by the
+// server
+func (s *postgresSession) drop() {
+	if s.conn == nil || s.conn.PingContext(context.Background()) == nil {
+		return
+	}
+	s.conn.Close()
+	s.conn = nil
+	s.held = make(map[string]int64)
+}
+
+// close ends the session, releasing its locks
+func (s *postgresSession) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.held = make(map[string]int64)
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func advisoryKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// Close ends every session, releasing every lock of the locker
+func (l *PostgresLocker) Close() error {
+	var firstErr error
+	for _, s := range l.sessions {
+		if err := s.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
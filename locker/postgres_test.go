@@ -0,0 +1,33 @@
+package locker_test
+
+import (
+	"database/sql"
+	"fmt"
+	"schedulerV2/locker"
+	"schedulerV2/migrations/migrationstest"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestPostgresLocker(t *testing.T) {
+	gormDB, err := gorm.Open(postgres.Open(migrationstest.DSN(t)), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gormDB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, sessions := range []int{1, locker.DefaultPostgresSessions} {
+		t.Run(fmt.Sprintf("%d sessions", sessions), func(t *testing.T) {
+			runConformance(t, func() locker.Locker {
+				return locker.NewPostgresLocker(func() (*sql.DB, error) { return db, nil }, sessions)
+			})
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package locker
+
+import (
+	"context"
+	"path"
+	"schedulerV2/zkclient"
+	"sync"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// ZooKeeperLocker takes locks as ephemeral nodes under basePath, they are dropped by ZooKeeper when the session of
+// the replica ends
+type ZooKeeperLocker struct {
+	// conn returns the current connection, it is replaced when the session is re-established
+	conn     func() *zk.Conn
+	basePath string
+
+	mu   sync.Mutex
+	held map[string]*zkclient.DistributedLock
+}
+
+func NewZooKeeperLocker(conn func() *zk.Conn, basePath string) *ZooKeeperLocker {
+	return &ZooKeeperLocker{conn: conn, basePath: basePath, held: make(map[string]*zkclient.DistributedLock)}
+}
+
+func (l *ZooKeeperLocker) TryAcquire(ctx context.Context, name string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.held[name]; found {
+		return false, nil
+	}
+
+	lock := zkclient.NewDistributedLock(l.conn(), l.basePath, name)
+	acquired, err := lock.Acquire()
+	if err != nil || !acquired {
+		return false, err
+	}
+	l.held[name] = lock
+	return true, nil
+}
+
+func (l *ZooKeeperLocker) Release(ctx context.Context, name string) error {
+	l.mu.Lock()
+	lock, found := l.held[name]
+	delete(l.held, name)
+	l.mu.Unlock()
+
+	if !found {
+		return ErrNotHeld
+	}
+	return lock.Release()
+}
+
+// Refresh checks that the lock node still exists and belongs to the session that created it
+func (l *ZooKeeperLocker) Refresh(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	lock, found := l.held[name]
+	l.mu.Unlock()
+	if !found {
+		return ErrNotHeld
+	}
+
+	exists, stat, err := lock.Conn.Exists(path.Join(l.basePath, name))
+	if err != nil {
+		return err
+	}
+	if !exists || stat.EphemeralOwner != lock.Conn.SessionID() {
+		l.mu.Lock()
+		delete(l.held, name)
+		l.mu.Unlock()
+		return ErrNotHeld
+	}
+	return nil
+}
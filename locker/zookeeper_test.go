@@ -0,0 +1,31 @@
+package locker_test
+
+import (
+	"os"
+	"schedulerV2/locker"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// zookeeperHostsVariable names the environment variable holding the comma-separated zookeeper servers of the test
+const zookeeperHostsVariable = "SCHEDULER_TEST_ZOOKEEPER_HOSTS"
+
+func TestZooKeeperLocker(t *testing.T) {
+	hosts := os.Getenv(zookeeperHostsVariable)
+	if hosts == "" {
+		t.Skipf("%s is not set", zookeeperHostsVariable)
+	}
+
+	runConformance(t, func() locker.Locker {
+		// Each replica has its own session
+		conn, _, err := zk.Connect(strings.Split(hosts, ","), 10*time.Second, zk.WithLogInfo(false))
+		if err != nil {
+			t.Fatalf("error connecting to zookeeper: %v", err)
+		}
+		t.Cleanup(conn.Close)
+		return locker.NewZooKeeperLocker(func() *zk.Conn { return conn }, "/lockertest")
+	})
+}
@@ -3,13 +3,18 @@ package main
 import (
 	"context"
 	"flag"
+	"net/http"
 	"os"
+	"os/signal"
 	"schedulerV2/config"
 	"schedulerV2/middleware"
 	"schedulerV2/models"
 	"schedulerV2/routers"
 	"schedulerV2/services"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -34,29 +39,47 @@ func init() {
 		lg.Fatal().Err(err).Msg("Failed to load configuration")
 	}
 
-	// Initialize database with refresh mechanism
-	if err := config.InitDBWithRefresh(); err != nil {
-		lg.Fatal().Err(err).Msg("Failed to initialize database")
-	}
-
-	config.InitZooKeeper(strings.Split(models.AppConfig.ZookeeperHosts, ",")) // list of zookeeper servers
-
-	services.InitServices()
-
 }
 
 func main() {
 
-	cleanup := config.InitTracer()
-	if cleanup != nil {
-		defer cleanup(context.Background())
+	// schedulerV2 migrate up|down [steps]|status manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
+	// schedulerV2 partition enable|maintain|status converts and maintains the partitioned message_queue and exits
+	if len(os.Args) > 1 && os.Args[1] == "partition" {
+		os.Exit(runPartition(os.Args[2:]))
 	}
 
 	portPtr := flag.String("port", ":9999", "the port to listen on")
+	migratePtr := flag.Bool("migrate", false, "apply pending schema migrations before starting")
 
 	// Parse the command-line arguments
 	flag.Parse()
 
+	// Initialize database with refresh mechanism
+	if err := config.InitDBWithRefresh(); err != nil {
+		lg.Fatal().Err(err).Msg("Failed to initialize database")
+	}
+
+	if err := ensureSchema(*migratePtr); err != nil {
+		lg.Fatal().Err(err).Msg("Database schema is not up to date")
+	}
+
+	if err := ensurePartitioning(); err != nil {
+		lg.Fatal().Err(err).Msg("message_queue partitioning does not match the config")
+	}
+
+	if models.AppConfig.LockBackend == models.LockZookeeper {
+		config.InitZooKeeper(strings.Split(models.AppConfig.ZookeeperHosts, ",")) // list of zookeeper servers
+	}
+
+	services.InitServices()
+
+	cleanup := config.InitTracer()
+
 	// Retrieve the port number from the flag
 	port := *portPtr
 
@@ -92,14 +115,62 @@ func main() {
 	schedulerV2.GET("/health", routers.HealthCheck)
 
 	schedulerV2.Use(middleware.InternalApiTokenValidator())
+	schedulerV2.GET("/metrics", routers.Metrics)
 	routers.SetupRouter(schedulerV2)
 
 	// Initialize scheduled tasks
-	go services.StartSchedulers()
+	services.StartSchedulers()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: port, Handler: router}
+	go func() {
+		lg.Info().Msgf("Starting server on port %s", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			lg.Fatal().Err(err).Msg("Failed to start server")
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown(server, cleanup)
+}
+
+// shutdown stops the API and the schedulers together, waits up to shutdown_timeout for in-flight requests and
+// callbacks, then flushes the tracer and closes the connections
+func shutdown(server *http.Server, cleanup func(context.Context) error) {
+	lg.Info().Msg("Shutting down, no new requests or messages are accepted")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(models.AppConfig.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := server.Shutdown(ctx); err != nil {
+			lg.Error().Msgf("Error shutting down the server: %v", err)
+		}
+	}()
+	if err := services.Shutdown(ctx); err != nil {
+		lg.Error().Msgf("Error draining the schedulers: %v", err)
+	}
+	wg.Wait()
 
-	lg.Info().Msgf("Starting server on port %s", port)
+	if cleanup != nil {
+		// The drain may have used up the deadline, the spans recorded during it still get flushed
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFlush()
+		if err := cleanup(flushCtx); err != nil {
+			lg.Error().Msgf("Error flushing the tracer: %v", err)
+		}
+	}
 
-	if err := router.Run(port); err != nil {
-		lg.Fatal().Err(err).Msg("Failed to start server")
+	if err := config.CloseDB(); err != nil {
+		lg.Error().Msgf("Error closing the database connection: %v", err)
 	}
+	config.CloseZooKeeper()
+
+	lg.Info().Msg("Shutdown complete")
 }
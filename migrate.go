@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"schedulerV2/config"
+	"schedulerV2/migrations"
+	"strconv"
+	"time"
+)
+
+// newMigrator returns a migrator on the configured database
+func newMigrator() (*migrations.Migrator, error) {
+	db, err := config.GetDBConnection()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	return migrations.NewMigrator(sqlDB)
+}
+
+// ensureSchema applies the pending migrations when apply is set, otherwise it refuses to start on an outdated schema
+func ensureSchema(apply bool) error {
+	migrator, err := newMigrator()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if apply {
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			lg.Info().Msgf("Applied migration %d_%s", m.Version, m.Name)
+		}
+		return err
+	}
+
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d migrations are pending, starting with %d_%s; run `schedulerV2 migrate up` or start with -migrate",
+			len(pending), pending[0].Version, pending[0].Name)
+	}
+	return nil
+}
+
+// runMigrate is the migrate subcommand, it returns the exit code
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: schedulerV2 migrate up | down [steps] | status")
+	}
+	fs.Parse(args)
+	if action := fs.Arg(0); action != "up" && action != "down" && action != "status" {
+		fs.Usage()
+		return 2
+	}
+
+	migrator, err := newMigrator()
+	if err != nil {
+		lg.Error().Msgf("%v", err)
+		return 1
+	}
+	ctx := context.Background()
+
+	switch fs.Arg(0) {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			lg.Error().Msgf("%v", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+
+	case "down":
+		steps := 1
+		if fs.NArg() > 1 {
+			steps, err = strconv.Atoi(fs.Arg(1))
+			if err != nil || steps < 1 {
+				fs.Usage()
+				return 2
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			lg.Error().Msgf("%v", err)
+			return 1
+		}
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			lg.Error().Msgf("%v", err)
+			return 1
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-30s %s\n", status.Version, status.Name, appliedAt)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package migrations_test
+
+import (
+	"context"
+	"database/sql"
+	"schedulerV2/migrations"
+	"schedulerV2/migrations/migrationstest"
+	"testing"
+)
+
+// openMigrator returns a migrator on a migrated test schema, with the count of known migrations
+func openMigrator(t *testing.T) (*sql.DB, *migrations.Migrator, int) {
+	t.Helper()
+	db, err := migrationstest.Open(t).DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := migrations.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, migrator, len(all)
+}
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL", name).Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func TestPendingOnlyReads(t *testing.T) {
+	db, migrator, count := openMigrator(t)
+	ctx := context.Background()
+
+	if pending, err := migrator.Pending(ctx); err != nil || len(pending) != 0 {
+		t.Fatalf("Pending = %v, %v, want none", pending, err)
+	}
+
+	if _, err := db.Exec("DROP TABLE schema_migrations"); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := migrator.Pending(ctx); err != nil || len(pending) != count {
+		t.Errorf("Pending without schema_migrations = %d, %v, want all %d", len(pending), err, count)
+	}
+	if tableExists(t, db, "schema_migrations") {
+		t.Error("Pending created schema_migrations")
+	}
+}
+
+func TestDownRefusesBaseline(t *testing.T) {
+	db, migrator, count := openMigrator(t)
+
+	reverted, err := migrator.Down(context.Background(), count)
+	if err == nil {
+		t.Fatal("Down reverted the baseline")
+	}
+	if len(reverted) != count-1 {
+		t.Errorf("reverted %d migrations, want every one but the baseline", len(reverted))
+	}
+	if !tableExists(t, db, "message_queue") {
+		t.Error("message_queue was dropped")
+	}
+}
@@ -0,0 +1,71 @@
+// Package migrationstest opens a Postgres schema with every migration applied for tests that need the database.
+// Tests using it are skipped unless SCHEDULER_TEST_DATABASE_DSN points at a database they may create schemas in.
+package migrationstest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"schedulerV2/migrations"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// DSNVariable names the environment variable holding the test database DSN, in key=value form
+const DSNVariable = "SCHEDULER_TEST_DATABASE_DSN"
+
+// DSN returns the test database DSN, skipping the test when it is not set
+func DSN(t testing.TB) string {
+	t.Helper()
+	dsn := os.Getenv(DSNVariable)
+	if dsn == "" {
+		t.Skipf("%s is not set", DSNVariable)
+	}
+	return dsn
+}
+
+// Open creates a schema of its own for the test, applies the migrations to it and returns a connection using it.
+// The schema is dropped when the test ends.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+	dsn := DSN(t)
+	schema := "test_" + strings.ReplaceAll(uuid.NewString()[:13], "-", "")
+
+	admin, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("error connecting to the test database: %v", err)
+	}
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("error creating schema %s: %v", schema, err)
+	}
+
+	db, err := gorm.Open(postgres.Open(fmt.Sprintf("%s search_path=%s", dsn, schema)), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("error connecting to schema %s: %v", schema, err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sqlDB.Close()
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if adminDB, err := admin.DB(); err == nil {
+			adminDB.Close()
+		}
+	})
+
+	migrator, err := migrations.NewMigrator(sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("error applying migrations: %v", err)
+	}
+	return db
+}
@@ -0,0 +1,5 @@
+-- The baseline adopts tables that existed before versioned migrations, reverting it would drop every message.
+DO $$
+BEGIN
+    RAISE EXCEPTION 'the baseline migration cannot be reverted, drop the tables by hand to remove the schema';
+END $$;
@@ -0,0 +1,114 @@
+-- The schema GORM AutoMigrate created before versioned migrations. Columns are added one by one so databases
+-- migrated by any earlier version catch up, and databases already up to date are left as they are.
+
+CREATE TABLE IF NOT EXISTS message_queue (
+    id                  bigserial PRIMARY KEY
+);
+
+ALTER TABLE message_queue
+    ADD COLUMN IF NOT EXISTS created_at          timestamptz,
+    ADD COLUMN IF NOT EXISTS updated_at          timestamptz,
+    ADD COLUMN IF NOT EXISTS deleted_at          timestamptz,
+    ADD COLUMN IF NOT EXISTS payload             jsonb NOT NULL,
+    ADD COLUMN IF NOT EXISTS callback_url        text NOT NULL,
+    ADD COLUMN IF NOT EXISTS status              text NOT NULL DEFAULT 'PENDING',
+    ADD COLUMN IF NOT EXISTS retry_count         bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS is_dlq              boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS next_retry          bigint NOT NULL,
+    ADD COLUMN IF NOT EXISTS count               bigint,
+    ADD COLUMN IF NOT EXISTS service_name        text,
+    ADD COLUMN IF NOT EXISTS message_type        text,
+    ADD COLUMN IF NOT EXISTS user_id             text,
+    ADD COLUMN IF NOT EXISTS time_duration       bigint,
+    ADD COLUMN IF NOT EXISTS dedupe_key          text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS dedupe_mode         text,
+    ADD COLUMN IF NOT EXISTS batch_callback      boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS http_method         text NOT NULL DEFAULT 'POST',
+    ADD COLUMN IF NOT EXISTS headers             jsonb,
+    ADD COLUMN IF NOT EXISTS query_params        jsonb,
+    ADD COLUMN IF NOT EXISTS callback_timeout    bigint,
+    ADD COLUMN IF NOT EXISTS delivery_deadline   bigint,
+    ADD COLUMN IF NOT EXISTS tls_profile         text,
+    ADD COLUMN IF NOT EXISTS last_error          text,
+    ADD COLUMN IF NOT EXISTS claimed_by          text,
+    ADD COLUMN IF NOT EXISTS lease_until         bigint,
+    ADD COLUMN IF NOT EXISTS orphan_count        bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS on_success_url      text,
+    ADD COLUMN IF NOT EXISTS on_dead_url         text,
+    ADD COLUMN IF NOT EXISTS on_dlq_url          text,
+    ADD COLUMN IF NOT EXISTS notification_event  text,
+    ADD COLUMN IF NOT EXISTS notification_status text,
+    ADD COLUMN IF NOT EXISTS notify_at           bigint,
+    ADD COLUMN IF NOT EXISTS notify_attempts     bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS store_result        boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS result              text,
+    ADD COLUMN IF NOT EXISTS result_truncated    boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS result_at           bigint,
+    ADD COLUMN IF NOT EXISTS scheduled_at        bigint,
+    ADD COLUMN IF NOT EXISTS payload_template    boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS trace_parent        text;
+
+CREATE INDEX IF NOT EXISTS idx_message_queue_deleted_at ON message_queue (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_status_message_type_is_dlq_retry_count ON message_queue (status, retry_count, is_dlq);
+CREATE INDEX IF NOT EXISTS idx_next_retry ON message_queue (next_retry);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_service_name_dedupe_key_pending ON message_queue (service_name, dedupe_key)
+    WHERE status = 'PENDING' AND dedupe_key <> '';
+CREATE INDEX IF NOT EXISTS idx_in_progress_lease_until ON message_queue (lease_until) WHERE status = 'IN-PROGRESS';
+CREATE INDEX IF NOT EXISTS idx_notification_pending ON message_queue (notification_status, notify_at)
+    WHERE notification_status = 'PENDING';
+
+CREATE TABLE IF NOT EXISTS dlq_message_queue (
+    id           varchar(36) PRIMARY KEY
+);
+
+ALTER TABLE dlq_message_queue
+    ADD COLUMN IF NOT EXISTS created_at   timestamptz,
+    ADD COLUMN IF NOT EXISTS updated_at   timestamptz,
+    ADD COLUMN IF NOT EXISTS deleted_at   timestamptz,
+    ADD COLUMN IF NOT EXISTS message_id   bigint NOT NULL,
+    ADD COLUMN IF NOT EXISTS is_processed boolean NOT NULL;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'fk_dlq_message_queue_message_queue_id') THEN
+        ALTER TABLE dlq_message_queue
+            ADD CONSTRAINT fk_dlq_message_queue_message_queue_id FOREIGN KEY (message_id) REFERENCES message_queue (id);
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS idx_dlq_message_queue_deleted_at ON dlq_message_queue (deleted_at);
+
+CREATE TABLE IF NOT EXISTS service_threshold (
+    id           bigserial PRIMARY KEY
+);
+
+ALTER TABLE service_threshold
+    ADD COLUMN IF NOT EXISTS created_at   timestamptz,
+    ADD COLUMN IF NOT EXISTS updated_at   timestamptz,
+    ADD COLUMN IF NOT EXISTS deleted_at   timestamptz,
+    ADD COLUMN IF NOT EXISTS "limit"      bigint NOT NULL,
+    ADD COLUMN IF NOT EXISTS count        bigint DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS start_time   bigint NOT NULL,
+    ADD COLUMN IF NOT EXISTS end_time     bigint NOT NULL,
+    ADD COLUMN IF NOT EXISTS service_name text NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_service_threshold_deleted_at ON service_threshold (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_service_threshold_service_name ON service_threshold (service_name);
+
+CREATE TABLE IF NOT EXISTS circuit_breaker (
+    id           bigserial PRIMARY KEY
+);
+
+ALTER TABLE circuit_breaker
+    ADD COLUMN IF NOT EXISTS created_at   timestamptz,
+    ADD COLUMN IF NOT EXISTS updated_at   timestamptz,
+    ADD COLUMN IF NOT EXISTS deleted_at   timestamptz,
+    ADD COLUMN IF NOT EXISTS host         text NOT NULL,
+    ADD COLUMN IF NOT EXISTS state        text NOT NULL DEFAULT 'CLOSED',
+    ADD COLUMN IF NOT EXISTS successes    bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS failures     bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS window_start bigint NOT NULL,
+    ADD COLUMN IF NOT EXISTS opened_at    bigint NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_circuit_breaker_deleted_at ON circuit_breaker (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_circuit_breaker_host ON circuit_breaker (host);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_message_queue_terminal_updated_at;
+DROP TABLE IF EXISTS message_queue_archive;
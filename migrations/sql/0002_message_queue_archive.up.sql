@@ -0,0 +1,13 @@
+-- Terminal messages past their retention period are moved here by the retention job. The columns follow
+-- message_queue in order, a migration adding a column to message_queue must add it here too.
+CREATE TABLE message_queue_archive (LIKE message_queue INCLUDING DEFAULTS);
+
+ALTER TABLE message_queue_archive
+    ADD PRIMARY KEY (id),
+    ADD COLUMN archived_at timestamptz NOT NULL DEFAULT now();
+
+CREATE INDEX idx_message_queue_archive_service_name_archived_at ON message_queue_archive (service_name, archived_at);
+
+-- Lets the retention job find old terminal messages without scanning the live ones
+CREATE INDEX idx_message_queue_terminal_updated_at ON message_queue (updated_at)
+    WHERE status IN ('COMPLETED', 'CANCELLED', 'DEAD') AND is_dlq = false;
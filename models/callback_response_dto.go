@@ -1,10 +1,48 @@
 package models
 
+import "encoding/json"
+
 type CallbackResponseDTO struct {
 	Data Data `json:"data"`
+	// Raw is the response body as received, stored on messages that ask for their result
+	Raw json.RawMessage `json:"-"`
+}
+
+func (r *CallbackResponseDTO) UnmarshalJSON(body []byte) error {
+	type plain CallbackResponseDTO
+	if err := json.Unmarshal(body, (*plain)(r)); err != nil {
+		return err
+	}
+	r.Raw = append(json.RawMessage(nil), body...)
+	return nil
 }
 
+// Data is the callback response. Version 2 of the protocol adds the retryAt, nextRetry, payload and reason fields.
 type Data struct {
-	Status   string `json:"status"`
-	Interval int64  `json:"interval"`
+	Version   int             `json:"version,omitempty"`
+	Status    string          `json:"status"`
+	Interval  int64           `json:"interval"`
+	RetryAt   int64           `json:"retryAt,omitempty"`
+	NextRetry int64           `json:"nextRetry,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+}
+
+// BatchCallbackRequestItem is a single message inside a batched callback request body
+type BatchCallbackRequestItem struct {
+	ID          uint            `json:"id"`
+	UserId      string          `json:"userId"`
+	Attempt     int             `json:"attempt"`
+	ScheduledAt int64           `json:"scheduledAt"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// BatchCallbackResponseDTO carries the per-message statuses returned by a batched callback
+type BatchCallbackResponseDTO struct {
+	Data []BatchData `json:"data"`
+}
+
+type BatchData struct {
+	ID uint `json:"id"`
+	Data
 }
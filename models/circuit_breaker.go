@@ -0,0 +1,29 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+type CircuitStateEnums string
+
+const (
+	CircuitClosed   CircuitStateEnums = "CLOSED"
+	CircuitOpen     CircuitStateEnums = "OPEN"
+	CircuitHalfOpen CircuitStateEnums = "HALF-OPEN"
+)
+
+// CircuitBreaker is the breaker state of a callback host, shared by all replicas
+type CircuitBreaker struct {
+	gorm.Model
+	ID          uint              `gorm:"primaryKey" json:"id"`
+	Host        string            `gorm:"uniqueIndex;not null" json:"host"`
+	State       CircuitStateEnums `gorm:"default:CLOSED;not null" json:"state"`
+	Successes   int64             `gorm:"default:0;not null" json:"successes"`
+	Failures    int64             `gorm:"default:0;not null" json:"failures"`
+	WindowStart int64             `gorm:"not null" json:"window_start"`
+	OpenedAt    int64             `gorm:"default:0;not null" json:"opened_at"`
+}
+
+func (CircuitBreaker) TableName() string {
+	return "circuit_breaker"
+}
@@ -19,6 +19,198 @@ type Config struct {
 	ServiceName             string `json:"service_name"`
 	CollectorURL            string `json:"otel_exporter_otlp_endpoint"`
 	InsecureMode            bool   `json:"insecure_mode"`
+	CallbackBatchMaxItems   int    `json:"callback_batch_max_items"`
+	CallbackBatchMaxBytes   int    `json:"callback_batch_max_bytes"`
+	CallbackTimeoutDefault  int    `json:"callback_timeout_default"`
+	CallbackTimeoutMax      int    `json:"callback_timeout_max"`
+	CallbackResultMaxBytes  int    `json:"callback_result_max_bytes"`
+	// ClaimMode is how replicas claim due messages, a lock per message or skip_locked row claims in Postgres
+	ClaimMode string `json:"claim_mode"`
+	// LockBackend is the Locker backing the lock claim mode, zookeeper, postgres or memory
+	LockBackend string `json:"lock_backend"`
+	// LockSessions is the no of dedicated connections holding the advisory locks of the postgres lock backend
+	LockSessions int `json:"lock_sessions"`
+	// ClaimLease is how long, in seconds, an IN-PROGRESS message is leased before the reaper may return it to PENDING
+	ClaimLease int `json:"claim_lease"`
+	// MaxOrphanings is how many expired leases a message survives before the reaper moves it to the DLQ
+	MaxOrphanings int `json:"max_orphanings"`
+	// ShutdownTimeout is how long, in seconds, a terminating replica waits for in-flight callbacks
+	ShutdownTimeout int `json:"shutdown_timeout"`
+
+	CallbackOutcomes  *CallbackOutcomeConfig   `json:"callback_outcomes"`
+	CallbackTransport *CallbackTransportConfig `json:"callback_transport"`
+	CircuitBreaker    *CircuitBreakerConfig    `json:"circuit_breaker"`
+	EventBus          *EventBusConfig          `json:"event_bus"`
+	CallbackGuard     *CallbackGuardConfig     `json:"callback_guard"`
+	CallbackProxy     *CallbackProxyConfig     `json:"callback_proxy"`
+	Retention         *RetentionConfig         `json:"retention"`
+	Partitioning      *PartitioningConfig      `json:"partitioning"`
+
+	GrpcTargets map[string]GrpcTargetConfig `json:"grpc_targets"`
+	TLSProfiles map[string]TLSProfileConfig `json:"tls_profiles"`
+
+	Services map[string]ServiceConfig `json:"services"`
+}
+
+// CallbackOutcomeConfig holds the rules mapping callback HTTP responses to delivery outcomes
+type CallbackOutcomeConfig struct {
+	EmptyBodySuccess     bool  `json:"empty_body_success"`
+	NonRetryable4xx      bool  `json:"non_retryable_4xx"`
+	Retryable4xxStatuses []int `json:"retryable_4xx_statuses"`
+	RetryAfterStatuses   []int `json:"retry_after_statuses"`
+}
+
+// CallbackTransportConfig tunes the HTTP transport shared by all callbacks, durations are in seconds
+type CallbackTransportConfig struct {
+	MaxIdleConns          int  `json:"max_idle_conns"`
+	MaxIdleConnsPerHost   int  `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int  `json:"max_conns_per_host"`
+	IdleConnTimeout       int  `json:"idle_conn_timeout"`
+	KeepAlive             int  `json:"keep_alive"`
+	DisableKeepAlives     bool `json:"disable_keep_alives"`
+	DialTimeout           int  `json:"dial_timeout"`
+	TLSHandshakeTimeout   int  `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout int  `json:"response_header_timeout"`
+	HTTP2                 bool `json:"http2"`
+}
+
+// CircuitBreakerConfig configures the per callback host circuit breaker, durations are in seconds
+type CircuitBreakerConfig struct {
+	Enabled bool `json:"enabled"`
+	// FailureRatio of failed callbacks within the window that opens the circuit
+	FailureRatio float64 `json:"failure_ratio"`
+	// MinRequests is the no of callbacks within the window required before the ratio is considered
+	MinRequests int `json:"min_requests"`
+	Window      int `json:"window"`
+	CoolDown    int `json:"cool_down"`
+}
+
+// EventBusConfig enables the nats:// and kafka:// callback sinks
+type EventBusConfig struct {
+	NatsUrl      string   `json:"nats_url"`
+	KafkaBrokers []string `json:"kafka_brokers"`
+	// InMemory serves both sinks from an in-process broker stand-in, for local environments
+	InMemory bool `json:"in_memory"`
+}
+
+// CallbackGuardConfig blocks callbacks to private, loopback and link-local addresses outside of AllowedCIDRs
+type CallbackGuardConfig struct {
+	Enabled      bool     `json:"enabled"`
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+}
+
+// CallbackProxyConfig routes http callbacks through outbound proxies. Without it the proxy is taken from the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+type CallbackProxyConfig struct {
+	// Rules are checked in order, the first rule matching the callback picks its proxy
+	Rules []ProxyRuleConfig `json:"rules"`
+	// NoProxy lists hosts, domains, IPs and CIDRs that always go direct, like NO_PROXY
+	NoProxy []string `json:"no_proxy"`
+	// FromEnvironment falls back to the environment variables when no rule matches, otherwise such callbacks go direct
+	FromEnvironment bool `json:"from_environment"`
+}
+
+// ProxyRuleConfig matches callbacks by host pattern and service, empty lists match everything.
+// A rule without a url sends matching callbacks direct.
+type ProxyRuleConfig struct {
+	Hosts    []string `json:"hosts"`
+	Services []string `json:"services"`
+	Url      string   `json:"url"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+}
+
+// RetentionConfig removes terminal messages from message_queue once they are older than their retention period
+type RetentionConfig struct {
+	Enabled bool `json:"enabled"`
+	// Days terminal messages are kept for services without their own retention_days
+	Days int `json:"days"`
+	// Mode is archive, moving the messages to message_queue_archive, or delete
+	Mode      string `json:"mode"`
+	BatchSize int    `json:"batch_size"`
+	// Interval is the seconds between retention runs
+	Interval int `json:"interval"`
+}
+
+const (
+	RetentionArchive = "archive"
+	RetentionDelete  = "delete"
+)
+
+// PartitioningConfig describes the range partitioning of message_queue. The table is converted with
+// schedulerV2 partition enable, the partitions are then created and detached by the service.
+type PartitioningConfig struct {
+	Enabled bool `json:"enabled"`
+	// Key is the partition column, only created_at is supported: it never changes, so updates never move a row to
+	// another partition and every update by id can be narrowed to the partition of the row
+	Key string `json:"key"`
+	// Days is the span of a partition
+	Days int `json:"days"`
+	// Premake is the no of partitions kept created ahead of the current one
+	Premake int `json:"premake"`
+	// Retain is the no of past partitions kept, older ones holding no live message are detached. 0 keeps them all.
+	Retain int `json:"retain"`
+	// DropDetached drops detached partitions instead of leaving them as standalone tables
+	DropDetached bool `json:"drop_detached"`
+	// Interval is the seconds between maintenance runs
+	Interval int `json:"interval"`
+}
+
+const PartitionByCreatedAt = "created_at"
+
+// GrpcTargetConfig holds the TLS settings of a grpc:// callback target, keyed by host:port in Config.GrpcTargets.
+// Targets without settings are called over plaintext.
+type GrpcTargetConfig struct {
+	TLS                bool   `json:"tls"`
+	CAFile             string `json:"ca_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// TLSProfile, when set, is used instead of the settings above
+	TLSProfile string `json:"tls_profile"`
+}
+
+// TLSProfileConfig is a named outbound TLS configuration that messages and services reference by name.
+// The files are reloaded when they change on disk.
+type TLSProfileConfig struct {
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	CAFile     string `json:"ca_file"`
+	ServerName string `json:"server_name"`
+	// MinVersion is one of 1.0, 1.1, 1.2 or 1.3, defaults to 1.2
+	MinVersion string `json:"min_version"`
+}
+
+// ServiceConfig holds the settings of a single producer service, keyed by service name in Config.Services
+type ServiceConfig struct {
+	SigningSecret string `json:"signing_secret"`
+	// TLSProfile is used for the callbacks of the service that do not name a profile themselves
+	TLSProfile string `json:"tls_profile"`
+	// AllowedCallbackUrls restricts the callback URLs the service can enqueue, any URL is accepted when empty.
+	// Entries are host patterns such as api.example.com or *.example.com, or URL prefixes such as
+	// https://hooks.example.com/billing/ whose host may also use a wildcard.
+	AllowedCallbackUrls []string `json:"allowed_callback_urls"`
+	// Terminal state notification URLs for messages of the service that do not set their own
+	OnSuccessUrl string `json:"on_success_url"`
+	OnDeadUrl    string `json:"on_dead_url"`
+	OnDlqUrl     string `json:"on_dlq_url"`
+	// RetentionDays overrides the retention period of the terminal messages of the service, -1 keeps them forever
+	RetentionDays int `json:"retention_days"`
+}
+
+const (
+	ClaimLock       = "lock"
+	ClaimSkipLocked = "skip_locked"
+)
+
+const (
+	LockZookeeper = "zookeeper"
+	LockPostgres  = "postgres"
+	LockMemory    = "memory"
+)
+
+// GetServiceConfig returns the settings of the service, or the zero value when it has none
+func (c *Config) GetServiceConfig(serviceName string) ServiceConfig {
+	return c.Services[serviceName]
 }
 
 // AppConfig holds the application's configuration.
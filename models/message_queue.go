@@ -8,12 +8,17 @@ import (
 
 type MessageStatusEnums string
 type MessageTypeEnums string
+type DedupeModeEnums string
+type EnqueueOutcomeEnums string
+type NotificationEventEnums string
+type NotificationStatusEnums string
 
 const (
 	PENDING    MessageStatusEnums = "PENDING"
 	COMPLETED  MessageStatusEnums = "COMPLETED"
 	INPROGRESS MessageStatusEnums = "IN-PROGRESS"
 	DEAD       MessageStatusEnums = "DEAD"
+	CANCELLED  MessageStatusEnums = "CANCELLED"
 )
 
 const (
@@ -21,20 +26,76 @@ const (
 	CRON      MessageTypeEnums = "CRON"
 )
 
+const (
+	DEBOUNCE DedupeModeEnums = "debounce"
+	THROTTLE DedupeModeEnums = "throttle"
+)
+
+const (
+	CREATED   EnqueueOutcomeEnums = "CREATED"
+	DEBOUNCED EnqueueOutcomeEnums = "DEBOUNCED"
+	THROTTLED EnqueueOutcomeEnums = "THROTTLED"
+)
+
+const (
+	NotifyCompleted NotificationEventEnums = "COMPLETED"
+	NotifyDead      NotificationEventEnums = "DEAD"
+	NotifyDLQ       NotificationEventEnums = "DLQ"
+)
+
+const (
+	NotificationPending NotificationStatusEnums = "PENDING"
+	NotificationSent    NotificationStatusEnums = "SENT"
+	NotificationFailed  NotificationStatusEnums = "FAILED"
+)
+
 type MessageQueue struct {
 	gorm.Model
-	ID           uint               `gorm:"primaryKey" json:"id"`
-	Payload      json.RawMessage    `gorm:"type:jsonb;not null" json:"payload" binding:"required"`
-	CallbackUrl  string             `gorm:"not null" json:"callback_url" binding:"required,url"`
-	Status       MessageStatusEnums `gorm:"index:idx_status_message_type_is_dlq_retry_count;default:PENDING;not null" json:"status"`
-	RetryCount   int                `gorm:"index:idx_status_message_type_is_dlq_retry_count;default:0;not null" json:"retry_count"`
-	IsDLQ        bool               `gorm:"index:idx_status_message_type_is_dlq_retry_count;default:false;not null" json:"is_dlq"`
-	NextRetry    int64              `gorm:"index:idx_next_retry;not null" json:"next_retry" binding:"required"`
-	Count        int                `json:"count"`
-	ServiceName  string             `json:"service_name"`
-	MessageType  MessageTypeEnums   `json:"message_type"`
-	UserId       string             `json:"user_id"`
-	TimeDuration int64              `json:"time_duration"`
+	ID               uint               `gorm:"primaryKey" json:"id"`
+	Payload          json.RawMessage    `gorm:"type:jsonb;not null" json:"payload" binding:"required"`
+	CallbackUrl      string             `gorm:"not null" json:"callback_url" binding:"required,url"`
+	Status           MessageStatusEnums `gorm:"index:idx_status_message_type_is_dlq_retry_count;default:PENDING;not null" json:"status"`
+	RetryCount       int                `gorm:"index:idx_status_message_type_is_dlq_retry_count;default:0;not null" json:"retry_count"`
+	IsDLQ            bool               `gorm:"index:idx_status_message_type_is_dlq_retry_count;default:false;not null" json:"is_dlq"`
+	NextRetry        int64              `gorm:"index:idx_next_retry;not null" json:"next_retry" binding:"required"`
+	Count            int                `json:"count"`
+	ServiceName      string             `gorm:"uniqueIndex:idx_service_name_dedupe_key_pending,priority:1,where:status = 'PENDING' AND dedupe_key <> ''" json:"service_name"`
+	MessageType      MessageTypeEnums   `json:"message_type"`
+	UserId           string             `json:"user_id"`
+	TimeDuration     int64              `json:"time_duration"`
+	DedupeKey        string             `gorm:"uniqueIndex:idx_service_name_dedupe_key_pending,priority:2,where:status = 'PENDING' AND dedupe_key <> '';default:'';not null" json:"dedupe_key"`
+	DedupeMode       DedupeModeEnums    `json:"dedupe_mode"`
+	BatchCallback    bool               `gorm:"default:false;not null" json:"batch_callback"`
+	HttpMethod       string             `gorm:"default:POST;not null" json:"http_method"`
+	Headers          StringMap          `gorm:"type:jsonb" json:"headers"`
+	QueryParams      StringMap          `gorm:"type:jsonb" json:"query_params"`
+	CallbackTimeout  int64              `json:"callback_timeout"`
+	DeliveryDeadline int64              `json:"delivery_deadline"`
+	TLSProfile       string             `json:"tls_profile"`
+	LastError        string             `gorm:"type:text" json:"last_error"`
+	ClaimedBy        string             `json:"claimed_by"`
+	LeaseUntil       int64              `gorm:"index:idx_in_progress_lease_until,where:status = 'IN-PROGRESS'" json:"lease_until"`
+	// OrphanCount is how many times the message was reaped after the replica processing it stopped renewing its lease
+	OrphanCount int `gorm:"default:0;not null" json:"orphan_count"`
+
+	OnSuccessUrl       string                  `json:"on_success_url"`
+	OnDeadUrl          string                  `json:"on_dead_url"`
+	OnDlqUrl           string                  `json:"on_dlq_url"`
+	NotificationEvent  NotificationEventEnums  `json:"notification_event"`
+	NotificationStatus NotificationStatusEnums `gorm:"index:idx_notification_pending,priority:1,where:notification_status = 'PENDING'" json:"notification_status"`
+	NotifyAt           int64                   `gorm:"index:idx_notification_pending,priority:2,where:notification_status = 'PENDING'" json:"notify_at"`
+	NotifyAttempts     int                     `gorm:"default:0;not null" json:"notify_attempts"`
+
+	StoreResult     bool   `gorm:"default:false;not null" json:"store_result"`
+	Result          string `gorm:"type:text" json:"result"`
+	ResultTruncated bool   `gorm:"default:false;not null" json:"result_truncated"`
+	ResultAt        int64  `json:"result_at"`
+
+	// ScheduledAt is the time the message was originally scheduled for, next_retry moves with every retry
+	ScheduledAt     int64 `json:"scheduled_at"`
+	PayloadTemplate bool  `gorm:"default:false;not null" json:"payload_template"`
+	// TraceParent is the W3C traceparent of the request that enqueued the message
+	TraceParent string `json:"trace_parent"`
 }
 
 func (MessageQueue) TableName() string {
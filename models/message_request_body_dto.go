@@ -2,19 +2,98 @@ package models
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
 )
 
+// deniedCallbackHeaders are hop-by-hop and authentication headers that messages cannot override
+var deniedCallbackHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Host":                true,
+	"Content-Length":      true,
+	"Authorization":       true,
+	"Cookie":              true,
+	"Internal-Api-Token":  true,
+
+	"X-Scheduler-Signature":    true,
+	"X-Scheduler-Timestamp":    true,
+	"X-Scheduler-Message-Id":   true,
+	"X-Scheduler-Attempt":      true,
+	"X-Scheduler-Scheduled-At": true,
+	"X-Scheduler-Message-Type": true,
+}
+
+// IsDeniedCallbackHeader reports whether the header cannot be set on a callback request by a message
+func IsDeniedCallbackHeader(name string) bool {
+	return deniedCallbackHeaders[http.CanonicalHeaderKey(name)]
+}
+
+// ValidateCallbackHeader reports why the header cannot be sent on a callback request, the name must be an RFC 7230
+// token and the value cannot hold control characters such as CR and LF
+func ValidateCallbackHeader(name, value string) error {
+	if name == "" {
+		return fmt.Errorf("header name cannot be empty")
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) {
+			return fmt.Errorf("header name %q is invalid", name)
+		}
+	}
+	if IsDeniedCallbackHeader(name) {
+		return fmt.Errorf("header %s cannot be set on the callback", name)
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return fmt.Errorf("header %s has an invalid value", name)
+		}
+	}
+	return nil
+}
+
+// isTokenChar reports whether c may appear in an RFC 7230 token
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
 type MessageRequestBodyDto struct {
-	Payload      json.RawMessage    `json:"payload" binding:"required"`
-	CallbackUrl  string             `json:"callbackUrl" binding:"required,url"`
-	Status       MessageStatusEnums `json:"status"`
-	NextRetry    int64              `json:"nextRetry" binding:"required"`
-	RetryCount   int                `json:"retryCount"`
-	ServiceName  string             `json:"serviceName,omitempty"`
-	UserId       string             `json:"userId"`
-	MessageType  MessageTypeEnums   `json:"messageType" binding:"required"`
-	TimeDuration int64              `json:"timeDuration"`
-	Count        int                `json:"count"`
+	Payload          json.RawMessage    `json:"payload" binding:"required"`
+	CallbackUrl      string             `json:"callbackUrl" binding:"required,url"`
+	Status           MessageStatusEnums `json:"status"`
+	NextRetry        int64              `json:"nextRetry" binding:"required"`
+	RetryCount       int                `json:"retryCount"`
+	ServiceName      string             `json:"serviceName,omitempty"`
+	UserId           string             `json:"userId"`
+	MessageType      MessageTypeEnums   `json:"messageType" binding:"required"`
+	TimeDuration     int64              `json:"timeDuration"`
+	Count            int                `json:"count"`
+	DedupeKey        string             `json:"dedupeKey" binding:"required_with=Mode"`
+	Mode             DedupeModeEnums    `json:"mode" binding:"required_with=DedupeKey,omitempty,oneof=debounce throttle"`
+	BatchCallback    bool               `json:"batchCallback"`
+	HttpMethod       string             `json:"httpMethod" binding:"omitempty,oneof=GET POST PUT PATCH DELETE"`
+	Headers          map[string]string  `json:"headers"`
+	QueryParams      map[string]string  `json:"queryParams"`
+	CallbackTimeout  int64              `json:"callbackTimeout" binding:"omitempty,min=1"`
+	DeliveryDeadline int64              `json:"deliveryDeadline" binding:"omitempty,gtfield=NextRetry"`
+	TLSProfile       string             `json:"tlsProfile"`
+	OnSuccessUrl     string             `json:"onSuccessUrl" binding:"omitempty,url"`
+	OnDeadUrl        string             `json:"onDeadUrl" binding:"omitempty,url"`
+	OnDlqUrl         string             `json:"onDlqUrl" binding:"omitempty,url"`
+	StoreResult      bool               `json:"storeResult"`
+	PayloadTemplate  bool               `json:"payloadTemplate"`
 }
 
 func (m *MessageRequestBodyDto) ToMessageQueue() (MessageQueue, error) {
@@ -24,17 +103,68 @@ func (m *MessageRequestBodyDto) ToMessageQueue() (MessageQueue, error) {
 		return MessageQueue{}, err
 	}
 
+	for name, value := range m.Headers {
+		if err := ValidateCallbackHeader(name, value); err != nil {
+			return MessageQueue{}, err
+		}
+	}
+
+	if m.DeliveryDeadline != 0 && m.MessageType != SCHEDULED {
+		return MessageQueue{}, fmt.Errorf("deliveryDeadline is only supported for SCHEDULED messages")
+	}
+
+	if m.CallbackTimeout > int64(AppConfig.CallbackTimeoutMax) {
+		return MessageQueue{}, fmt.Errorf("callbackTimeout cannot exceed %d seconds", AppConfig.CallbackTimeoutMax)
+	}
+
+	if _, found := AppConfig.TLSProfiles[m.TLSProfile]; m.TLSProfile != "" && !found {
+		return MessageQueue{}, fmt.Errorf("unknown tlsProfile %s", m.TLSProfile)
+	}
+
+	httpMethod := m.HttpMethod
+	if httpMethod == "" {
+		httpMethod = http.MethodPost
+	}
+
+	if m.BatchCallback && (httpMethod != http.MethodPost || len(m.Headers) > 0 || len(m.QueryParams) > 0 || !isHTTPCallback(m.CallbackUrl)) {
+		return MessageQueue{}, fmt.Errorf("batchCallback only supports http POST callbacks without custom headers or query parameters")
+	}
+
+	if m.BatchCallback && m.StoreResult {
+		return MessageQueue{}, fmt.Errorf("storeResult is not supported with batchCallback")
+	}
+
 	return MessageQueue{
-		Payload:      payloadBytes,
-		CallbackUrl:  m.CallbackUrl,
-		Status:       m.Status,
-		IsDLQ:        false,
-		RetryCount:   m.RetryCount,
-		NextRetry:    m.NextRetry,
-		MessageType:  m.MessageType,
-		ServiceName:  m.ServiceName,
-		UserId:       m.UserId,
-		Count:        m.Count,
-		TimeDuration: m.TimeDuration,
+		Payload:          payloadBytes,
+		CallbackUrl:      m.CallbackUrl,
+		Status:           m.Status,
+		IsDLQ:            false,
+		RetryCount:       m.RetryCount,
+		NextRetry:        m.NextRetry,
+		MessageType:      m.MessageType,
+		ServiceName:      m.ServiceName,
+		UserId:           m.UserId,
+		Count:            m.Count,
+		TimeDuration:     m.TimeDuration,
+		DedupeKey:        m.DedupeKey,
+		DedupeMode:       m.Mode,
+		BatchCallback:    m.BatchCallback,
+		HttpMethod:       httpMethod,
+		Headers:          m.Headers,
+		QueryParams:      m.QueryParams,
+		CallbackTimeout:  m.CallbackTimeout,
+		DeliveryDeadline: m.DeliveryDeadline,
+		TLSProfile:       m.TLSProfile,
+		OnSuccessUrl:     m.OnSuccessUrl,
+		OnDeadUrl:        m.OnDeadUrl,
+		OnDlqUrl:         m.OnDlqUrl,
+		StoreResult:      m.StoreResult,
+		ScheduledAt:      m.NextRetry,
+		PayloadTemplate:  m.PayloadTemplate,
 	}, err
 }
+
+func isHTTPCallback(callbackUrl string) bool {
+	parsed, err := url.Parse(callbackUrl)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https")
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateCallbackHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		wantErr bool
+	}{
+		{"plain", "X-Request-Source", "billing", false},
+		{"token characters", "X_Custom.Header~1", "v", false},
+		{"tab in value", "X-List", "a\tb", false},
+		{"empty value", "X-Empty", "", false},
+		{"utf-8 value", "X-Name", "café", false},
+		{"empty name", "", "v", true},
+		{"space in name", "X Custom", "v", true},
+		{"colon in name", "X-Custom:", "v", true},
+		{"newline in name", "X-Custom\n", "v", true},
+		{"crlf in value", "X-Custom", "v\r\nX-Injected: 1", true},
+		{"lf in value", "X-Custom", "v\nw", true},
+		{"nul in value", "X-Custom", "v\x00", true},
+		{"del in value", "X-Custom", "v\x7f", true},
+		{"denied header", "Authorization", "Bearer x", true},
+		{"denied header in other case", "transfer-encoding", "chunked", true},
+		{"scheduler header", "X-Scheduler-Signature", "v1=x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateCallbackHeader(tt.header, tt.value); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestToMessageQueueRejectsInvalidHeaders(t *testing.T) {
+	previous := AppConfig
+	AppConfig = Config{CallbackTimeoutMax: 300}
+	t.Cleanup(func() { AppConfig = previous })
+
+	dto := MessageRequestBodyDto{
+		Payload:     json.RawMessage(`{}`),
+		CallbackUrl: "https://example.com/callback",
+		NextRetry:   1700000000,
+		MessageType: SCHEDULED,
+		Headers:     map[string]string{"X-Custom": "v\r\nX-Injected: 1"},
+	}
+	if _, err := dto.ToMessageQueue(); err == nil {
+		t.Fatal("a header value with CR/LF was accepted")
+	}
+
+	dto.Headers = map[string]string{"X-Custom": "v"}
+	message, err := dto.ToMessageQueue()
+	if err != nil {
+		t.Fatalf("a valid header was rejected: %v", err)
+	}
+	if message.Headers["X-Custom"] != "v" {
+		t.Errorf("got headers %v, want the ones of the request", message.Headers)
+	}
+}
@@ -0,0 +1,11 @@
+package models
+
+// MessageResultDTO is the stored callback response of a message that was enqueued with storeResult
+type MessageResultDTO struct {
+	ID              uint               `json:"id"`
+	Status          MessageStatusEnums `json:"status"`
+	IsDLQ           bool               `json:"isDlq"`
+	Result          string             `json:"result"`
+	ResultTruncated bool               `json:"resultTruncated"`
+	ResultAt        int64              `json:"resultAt"`
+}
@@ -0,0 +1,13 @@
+package models
+
+// TerminalNotificationDTO is the body POSTed to onSuccessUrl, onDeadUrl and onDlqUrl. Status is COMPLETED, DEAD or DLQ.
+type TerminalNotificationDTO struct {
+	ID          uint   `json:"id"`
+	ServiceName string `json:"serviceName"`
+	UserId      string `json:"userId"`
+	Status      string `json:"status"`
+	// Attempts is the no of callbacks sent for the message, a message delivered on its first try reports 1. It is
+	// derived from retry_count, which does not count the callback that finished a scheduled message.
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"lastError,omitempty"`
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"schedulerV2/config"
+	"schedulerV2/models"
+	"schedulerV2/partitioning"
+	"time"
+)
+
+// newPartitionManager returns a partition manager on the configured database
+func newPartitionManager() (*partitioning.Manager, error) {
+	db, err := config.GetDBConnection()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	return partitioning.NewManager(sqlDB, *models.AppConfig.Partitioning), nil
+}
+
+// ensurePartitioning refuses to start when message_queue is not partitioned as configured, enqueues would otherwise
+// rely on a dedupe index the table does not have
+func ensurePartitioning() error {
+	manager, err := newPartitionManager()
+	if err != nil {
+		return err
+	}
+	key, err := manager.Key(context.Background())
+	if err != nil {
+		return err
+	}
+
+	cfg := models.AppConfig.Partitioning
+	switch {
+	case cfg.Enabled && key == "":
+		return fmt.Errorf("partitioning is enabled but message_queue is not partitioned; run `schedulerV2 partition enable`")
+	case !cfg.Enabled && key != "":
+		return fmt.Errorf("message_queue is partitioned by %s but partitioning is disabled in the config", key)
+	case cfg.Enabled && key != cfg.Key:
+		return fmt.Errorf("message_queue is partitioned by %s but the config asks for %s", key, cfg.Key)
+	}
+	return nil
+}
+
+// runPartition is the partition subcommand, it returns the exit code
+func runPartition(args []string) int {
+	fs := flag.NewFlagSet("partition", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: schedulerV2 partition enable | maintain | status")
+	}
+	fs.Parse(args)
+	if action := fs.Arg(0); action != "enable" && action != "maintain" && action != "status" {
+		fs.Usage()
+		return 2
+	}
+	if fs.Arg(0) != "status" && !models.AppConfig.Partitioning.Enabled {
+		lg.Error().Msg("partitioning is disabled in the config")
+		return 1
+	}
+
+	manager, err := newPartitionManager()
+	if err != nil {
+		lg.Error().Msgf("%v", err)
+		return 1
+	}
+	ctx := context.Background()
+
+	switch fs.Arg(0) {
+	case "enable":
+		if err := manager.Convert(ctx, time.Now()); err != nil {
+			lg.Error().Msgf("%v", err)
+			return 1
+		}
+		fmt.Printf("message_queue is partitioned by %s\n", models.AppConfig.Partitioning.Key)
+
+	case "maintain":
+		result, err := manager.Maintain(ctx, time.Now())
+		for _, name := range result.Created {
+			fmt.Printf("created %s\n", name)
+		}
+		for _, name := range result.Detached {
+			fmt.Printf("detached %s\n", name)
+		}
+		for _, name := range result.Dropped {
+			fmt.Printf("dropped %s\n", name)
+		}
+		for _, name := range result.Kept {
+			fmt.Printf("kept %s, it holds live messages\n", name)
+		}
+		if err != nil {
+			lg.Error().Msgf("%v", err)
+			return 1
+		}
+
+	case "status":
+		key, err := manager.Key(ctx)
+		if err != nil {
+			lg.Error().Msgf("%v", err)
+			return 1
+		}
+		if key == "" {
+			fmt.Println("message_queue is not partitioned")
+			return 0
+		}
+		partitions, err := manager.Partitions(ctx)
+		if err != nil {
+			lg.Error().Msgf("%v", err)
+			return 1
+		}
+		fmt.Printf("message_queue is partitioned by %s\n", key)
+		for _, partition := range partitions {
+			fmt.Printf("%-32s %s\n", partition.Name, partitionRange(partition))
+		}
+	}
+	return 0
+}
+
+// partitionRange prints the bounds of the partition as times
+func partitionRange(partition partitioning.Partition) string {
+	if partition.IsDefault {
+		return "default"
+	}
+	bound := func(unix int64) string {
+		switch unix {
+		case math.MinInt64:
+			return "MINVALUE"
+		case math.MaxInt64:
+			return "MAXVALUE"
+		}
+		return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+	}
+	return bound(partition.From) + " .. " + bound(partition.To)
+}
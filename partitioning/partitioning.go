@@ -0,0 +1,433 @@
+// Package partitioning converts message_queue into a table range partitioned by created_at and maintains its
+// partitions: partitions are created ahead of time, and old partitions holding no live message are detached.
+package partitioning
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+	"schedulerV2/migrations"
+	"schedulerV2/models"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	table            = "message_queue"
+	legacyTable      = "message_queue_legacy"
+	defaultPartition = "message_queue_default"
+	// dlqForeignKey references message_queue(id), which cannot be unique on its own once the table is partitioned
+	dlqForeignKey = "fk_dlq_message_queue_message_queue_id"
+	// dlqMessageCheck replaces the foreign key for new DLQ rows. Nothing deletes a DLQ message from message_queue:
+	// retention skips them and a partition holding one is never detached.
+	dlqMessageCheck = `CREATE OR REPLACE FUNCTION dlq_message_queue_check_message() RETURNS trigger AS $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM message_queue WHERE id = NEW.message_id) THEN
+		RAISE EXCEPTION 'message % of the DLQ is not in message_queue', NEW.message_id USING ERRCODE = 'foreign_key_violation';
+	END IF;
+	RETURN NEW;
+END $$ LANGUAGE plpgsql`
+	dlqMessageTrigger = "dlq_message_queue_message_exists"
+	// liveMessages matches the rows a partition must not be detached with
+	liveMessages = "status NOT IN ('COMPLETED', 'CANCELLED', 'DEAD') OR is_dlq OR notification_status = 'PENDING'"
+	// timestampLayout is how bounds on created_at are written and read back with the session time zone set to UTC
+	timestampLayout = "2006-01-02 15:04:05-07"
+)
+
+var boundPattern = regexp.MustCompile(`FROM \((.+)\) TO \((.+)\)`)
+
+// Partition is a partition of message_queue with its bounds in unix seconds, From is math.MinInt64 for MINVALUE
+type Partition struct {
+	Name      string
+	From      int64
+	To        int64
+	IsDefault bool
+}
+
+// Result lists the partitions a maintenance run changed
+type Result struct {
+	Created  []string
+	Detached []string
+	Dropped  []string
+	// Kept are old partitions not detached because they still hold live messages
+	Kept []string
+}
+
+type Manager struct {
+	db  *sql.DB
+	cfg models.PartitioningConfig
+}
+
+func NewManager(db *sql.DB, cfg models.PartitioningConfig) *Manager {
+	return &Manager{db: db, cfg: cfg}
+}
+
+// Key returns the partition key of message_queue, empty when the table is not partitioned
+func (m *Manager) Key(ctx context.Context) (string, error) {
+	var def sql.NullString
+	if err := m.db.QueryRowContext(ctx, "SELECT pg_get_partkeydef($1::regclass)", table).Scan(&def); err != nil {
+		return "", err
+	}
+	if !def.Valid {
+		return "", nil
+	}
+	// The definition reads RANGE (created_at)
+	key := strings.TrimSuffix(strings.TrimPrefix(def.String, "RANGE ("), ")")
+	return key, nil
+}
+
+// Partitions lists the partitions of message_queue ordered by their lower bound, the default partition last
+func (m *Manager) Partitions(ctx context.Context) ([]Partition, error) {
+	tx, err := m.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return m.partitions(ctx, tx)
+}
+
+// Convert turns the single message_queue table into a partitioned one without copying it: the table becomes the
+// message_queue_legacy partition holding every key before the next period, rows created after it are moved to the
+// new partitions. The schema must be migrated first, the conversion holds the migration lock and the table is locked
+// for the duration.
+func (m *Manager) Convert(ctx context.Context, now time.Time) error {
+	key, err := m.Key(ctx)
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		return fmt.Errorf("%s is already partitioned by %s", table, key)
+	}
+
+	migrator, err := migrations.NewMigrator(m.db)
+	if err != nil {
+		return err
+	}
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading the migration status: %v", err)
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("the schema has %d pending migrations; run `schedulerV2 migrate up` first", len(pending))
+	}
+
+	tx, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := migrations.Lock(ctx, tx); err != nil {
+		return err
+	}
+
+	exec := func(query string, args ...interface{}) {
+		if err == nil {
+			if _, execErr := tx.ExecContext(ctx, query, args...); execErr != nil {
+				err = fmt.Errorf("%v, running %s", execErr, strings.SplitN(query, "\n", 2)[0])
+			}
+		}
+	}
+
+	exec("LOCK TABLE " + table + " IN ACCESS EXCLUSIVE MODE")
+	// Rows without a key could only go to the default partition
+	exec("UPDATE " + table + " SET created_at = COALESCE(updated_at, now()) WHERE created_at IS NULL")
+	exec("ALTER TABLE " + table + " ALTER COLUMN created_at SET NOT NULL")
+	if err != nil {
+		return err
+	}
+
+	indexes, err := tableIndexes(ctx, tx)
+	if err != nil {
+		return err
+	}
+	var sequence sql.NullString
+	if err := tx.QueryRowContext(ctx, "SELECT pg_get_serial_sequence($1, 'id')", table).Scan(&sequence); err != nil {
+		return err
+	}
+
+	exec("ALTER TABLE dlq_message_queue DROP CONSTRAINT IF EXISTS " + dlqForeignKey)
+	exec("ALTER TABLE " + table + " RENAME TO " + legacyTable)
+	for _, index := range indexes {
+		if index.primary {
+			// A partition can only have the (id, key) primary key of the parent, it is built when attaching
+			exec("ALTER TABLE " + legacyTable + " DROP CONSTRAINT " + index.name)
+			continue
+		}
+		exec("ALTER INDEX " + index.name + " RENAME TO " + legacyIndexName(index.name))
+	}
+
+	exec("CREATE TABLE " + table + " (LIKE " + legacyTable + " INCLUDING DEFAULTS INCLUDING CONSTRAINTS) PARTITION BY RANGE (" + m.cfg.Key + ")")
+	if sequence.Valid {
+		// The sequence would otherwise be dropped with the legacy partition
+		exec("ALTER SEQUENCE " + sequence.String + " OWNED BY " + table + ".id")
+	}
+	exec("ALTER TABLE " + table + " ADD PRIMARY KEY (id, " + m.cfg.Key + ")")
+	for _, index := range indexes {
+		if index.primary {
+			continue
+		}
+		// A unique index on a partitioned table must contain the partition key, which would make the dedupe index
+		// useless, so unique indexes are recreated as plain ones and dedupe takes an advisory lock instead
+		exec(strings.Replace(index.def, "CREATE UNIQUE INDEX", "CREATE INDEX", 1))
+	}
+
+	cutoff := m.periodStart(now) + m.span()
+	exec("CREATE TEMP TABLE moved_messages (LIKE " + legacyTable + ") ON COMMIT DROP")
+	exec("WITH moved AS (DELETE FROM " + legacyTable + " WHERE " + m.cfg.Key + " >= " + literal(cutoff) + " RETURNING *) INSERT INTO moved_messages SELECT * FROM moved")
+	exec("ALTER TABLE " + table + " ATTACH PARTITION " + legacyTable + " FOR VALUES FROM (MINVALUE) TO (" + literal(cutoff) + ")")
+	exec("CREATE TABLE " + defaultPartition + " PARTITION OF " + table + " DEFAULT")
+	for from := cutoff; from <= m.periodStart(now)+int64(m.cfg.Premake)*m.span(); from += m.span() {
+		exec("CREATE TABLE " + m.partitionName(from) + " PARTITION OF " + table + " FOR VALUES FROM (" + literal(from) + ") TO (" + literal(from+m.span()) + ")")
+	}
+	exec("INSERT INTO " + table + " SELECT * FROM moved_messages")
+	exec(dlqMessageCheck)
+	exec("CREATE TRIGGER " + dlqMessageTrigger + " AFTER INSERT OR UPDATE OF message_id ON dlq_message_queue FOR EACH ROW EXECUTE FUNCTION dlq_message_queue_check_message()")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Maintain creates the partitions from the current period to Premake periods ahead, and detaches the partitions
+// that ended more than Retain periods ago when they hold no live message
+func (m *Manager) Maintain(ctx context.Context, now time.Time) (Result, error) {
+	var result Result
+	partitions, err := m.Partitions(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	current := m.periodStart(now)
+	for from := current; from <= current+int64(m.cfg.Premake)*m.span(); from += m.span() {
+		if covered(partitions, from, from+m.span()) {
+			continue
+		}
+		name := m.partitionName(from)
+		if err := m.createPartition(ctx, name, from, from+m.span()); err != nil {
+			return result, fmt.Errorf("error creating partition %s: %v", name, err)
+		}
+		result.Created = append(result.Created, name)
+	}
+
+	if m.cfg.Retain <= 0 {
+		return result, nil
+	}
+	threshold := current - int64(m.cfg.Retain)*m.span()
+	for _, partition := range partitions {
+		if partition.IsDefault || partition.To > threshold {
+			continue
+		}
+		detached, err := m.detachPartition(ctx, partition.Name)
+		if err != nil {
+			return result, fmt.Errorf("error detaching partition %s: %v", partition.Name, err)
+		}
+		if !detached {
+			result.Kept = append(result.Kept, partition.Name)
+			continue
+		}
+		if m.cfg.DropDetached {
+			result.Dropped = append(result.Dropped, partition.Name)
+		} else {
+			result.Detached = append(result.Detached, partition.Name)
+		}
+	}
+	return result, nil
+}
+
+// createPartition creates the partition as a table, moves the rows of its range out of the default partition and
+// attaches it, a partition cannot be created while the default partition holds rows of its range
+func (m *Manager) createPartition(ctx context.Context, name string, from, to int64) error {
+	tx, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := migrations.Lock(ctx, tx); err != nil {
+		return err
+	}
+
+	statements := []string{
+		"CREATE TABLE " + name + " (LIKE " + table + " INCLUDING DEFAULTS INCLUDING CONSTRAINTS)",
+		"WITH moved AS (DELETE FROM " + defaultPartition + " WHERE " + m.cfg.Key + " >= " + literal(from) + " AND " + m.cfg.Key + " < " + literal(to) + " RETURNING *) INSERT INTO " + name + " SELECT * FROM moved",
+		"ALTER TABLE " + table + " ATTACH PARTITION " + name + " FOR VALUES FROM (" + literal(from) + ") TO (" + literal(to) + ")",
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// detachPartition detaches the partition, and drops it when configured, unless it holds live messages. The check
+// runs after the detach so no message can be written to the partition in between.
+func (m *Manager) detachPartition(ctx context.Context, name string) (bool, error) {
+	tx, err := m.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if err := migrations.Lock(ctx, tx); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" DETACH PARTITION "+name); err != nil {
+		return false, err
+	}
+	var live bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM "+name+" WHERE "+liveMessages+")").Scan(&live); err != nil {
+		return false, err
+	}
+	if live {
+		return false, nil
+	}
+	if m.cfg.DropDetached {
+		if _, err := tx.ExecContext(ctx, "DROP TABLE "+name); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// begin starts a transaction reading and writing timestamps in UTC
+func (m *Manager) begin(ctx context.Context) (*sql.Tx, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SET LOCAL TimeZone = 'UTC'"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (m *Manager) partitions(ctx context.Context, tx *sql.Tx) ([]Partition, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT c.relname, pg_get_expr(c.relpartbound, c.oid)
+		FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = $1::regclass`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []Partition
+	for rows.Next() {
+		var name, bound string
+		if err := rows.Scan(&name, &bound); err != nil {
+			return nil, err
+		}
+		if bound == "DEFAULT" {
+			partitions = append(partitions, Partition{Name: name, IsDefault: true})
+			continue
+		}
+
+		match := boundPattern.FindStringSubmatch(bound)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected bound of partition %s: %s", name, bound)
+		}
+		from, err := parseBound(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %v", name, err)
+		}
+		to, err := parseBound(match[2])
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %v", name, err)
+		}
+		partitions = append(partitions, Partition{Name: name, From: from, To: to})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].IsDefault != partitions[j].IsDefault {
+			return partitions[j].IsDefault
+		}
+		return partitions[i].From < partitions[j].From
+	})
+	return partitions, nil
+}
+
+func (m *Manager) span() int64 {
+	return int64(m.cfg.Days) * 24 * 60 * 60
+}
+
+// periodStart aligns the time on the partition span, counted from the unix epoch
+func (m *Manager) periodStart(t time.Time) int64 {
+	unix := t.Unix()
+	return unix - unix%m.span()
+}
+
+func (m *Manager) partitionName(from int64) string {
+	return table + "_p" + time.Unix(from, 0).UTC().Format("20060102")
+}
+
+// literal writes a bound in unix seconds as a created_at value
+func literal(unix int64) string {
+	return "'" + time.Unix(unix, 0).UTC().Format(timestampLayout) + "'"
+}
+
+// parseBound reads a bound written by pg_get_expr, a timestamp in UTC
+func parseBound(bound string) (int64, error) {
+	switch bound {
+	case "MINVALUE":
+		return math.MinInt64, nil
+	case "MAXVALUE":
+		return math.MaxInt64, nil
+	}
+	t, err := time.Parse(timestampLayout, strings.Trim(bound, "'"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid bound %s: %v", bound, err)
+	}
+	return t.Unix(), nil
+}
+
+// covered reports whether a partition other than the default one overlaps the range
+func covered(partitions []Partition, from, to int64) bool {
+	for _, partition := range partitions {
+		if !partition.IsDefault && partition.From < to && partition.To > from {
+			return true
+		}
+	}
+	return false
+}
+
+type tableIndex struct {
+	name    string
+	def     string
+	primary bool
+}
+
+// tableIndexes returns the indexes of message_queue with their definitions
+func tableIndexes(ctx context.Context, tx *sql.Tx) ([]tableIndex, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT c.relname, pg_get_indexdef(i.indexrelid), i.indisprimary
+		FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE i.indrelid = $1::regclass`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var indexes []tableIndex
+	for rows.Next() {
+		var index tableIndex
+		if err := rows.Scan(&index.name, &index.def, &index.primary); err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, rows.Err()
+}
+
+// legacyIndexName keeps index names within the 63 characters Postgres allows
+func legacyIndexName(name string) string {
+	const suffix = "_legacy"
+	if len(name)+len(suffix) > 63 {
+		name = name[:63-len(suffix)]
+	}
+	return name + suffix
+}
@@ -0,0 +1,191 @@
+package partitioning
+
+import (
+	"context"
+	"math"
+	"schedulerV2/migrations"
+	"schedulerV2/migrations/migrationstest"
+	"schedulerV2/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBounds(t *testing.T) {
+	from := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC).Unix()
+	if got := literal(from); got != "'2026-10-15 00:00:00+00'" {
+		t.Errorf("literal = %s", got)
+	}
+
+	tests := []struct {
+		bound string
+		want  int64
+	}{
+		{"MINVALUE", math.MinInt64},
+		{"MAXVALUE", math.MaxInt64},
+		{literal(from), from},
+	}
+	for _, test := range tests {
+		got, err := parseBound(test.bound)
+		if err != nil || got != test.want {
+			t.Errorf("parseBound(%s) = %d, %v, want %d", test.bound, got, err, test.want)
+		}
+	}
+	if _, err := parseBound("1760486400"); err == nil {
+		t.Error("parseBound accepted an integer bound")
+	}
+}
+
+func TestPeriods(t *testing.T) {
+	m := NewManager(nil, models.PartitioningConfig{Key: models.PartitionByCreatedAt, Days: 7})
+	now := time.Date(2026, 10, 19, 13, 30, 0, 0, time.UTC)
+
+	start := m.periodStart(now)
+	if start > now.Unix() || now.Unix()-start >= m.span() || start%m.span() != 0 {
+		t.Errorf("periodStart(%v) = %v", now, time.Unix(start, 0).UTC())
+	}
+	if got := m.partitionName(start); got != "message_queue_p"+time.Unix(start, 0).UTC().Format("20060102") {
+		t.Errorf("partitionName = %s", got)
+	}
+
+	partitions := []Partition{
+		{Name: "message_queue_legacy", From: math.MinInt64, To: start},
+		{Name: m.partitionName(start), From: start, To: start + m.span()},
+		{Name: defaultPartition, IsDefault: true},
+	}
+	if !covered(partitions, start, start+m.span()) {
+		t.Error("current period is not covered")
+	}
+	if covered(partitions, start+m.span(), start+2*m.span()) {
+		t.Error("next period is covered by the default partition")
+	}
+}
+
+func TestLegacyIndexName(t *testing.T) {
+	if got := legacyIndexName("idx_status"); got != "idx_status_legacy" {
+		t.Errorf("legacyIndexName = %s", got)
+	}
+	if got := legacyIndexName(strings.Repeat("x", 63)); len(got) != 63 || !strings.HasSuffix(got, "_legacy") {
+		t.Errorf("legacyIndexName of a 63 character name = %s", got)
+	}
+}
+
+// openManager returns a manager on a migrated test schema
+func openManager(t *testing.T) *Manager {
+	t.Helper()
+	db := migrationstest.Open(t)
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewManager(sqlDB, models.PartitioningConfig{Enabled: true, Key: models.PartitionByCreatedAt, Days: 7, Premake: 2, Retain: 1})
+}
+
+func TestConvert(t *testing.T) {
+	m := openManager(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	insert := `INSERT INTO message_queue (payload, callback_url, status, next_retry, service_name, message_type, created_at, updated_at)
+		VALUES ('{}', 'https://example.com/callback', 'PENDING', 0, 'billing', 'SCHEDULED', $1, $1)`
+	for _, createdAt := range []time.Time{now.AddDate(0, 0, -30), now, now.AddDate(0, 0, 10)} {
+		if _, err := m.db.Exec(insert, createdAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.Convert(ctx, now); err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	if key, err := m.Key(ctx); err != nil || key != models.PartitionByCreatedAt {
+		t.Fatalf("Key = %q, %v, want created_at", key, err)
+	}
+	if err := m.Convert(ctx, now); err == nil {
+		t.Error("Convert of a partitioned table succeeded")
+	}
+
+	partitions, err := m.Partitions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cutoff := m.periodStart(now) + m.span()
+	if first := partitions[0]; first.Name != legacyTable || first.From != math.MinInt64 || first.To != cutoff {
+		t.Errorf("first partition %+v, want %s up to %d", first, legacyTable, cutoff)
+	}
+	if last := partitions[len(partitions)-1]; !last.IsDefault {
+		t.Errorf("last partition %+v, want the default one", last)
+	}
+
+	var legacy, total int
+	if err := m.db.QueryRow("SELECT count(*) FROM " + legacyTable).Scan(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.db.QueryRow("SELECT count(*) FROM " + table).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	if legacy != 2 || total != 3 {
+		t.Errorf("%d of %d messages in the legacy partition, want 2 of 3", legacy, total)
+	}
+
+	if _, err := m.db.Exec("INSERT INTO dlq_message_queue (id, message_id, is_processed) VALUES ('missing', 0, false)"); err == nil {
+		t.Error("DLQ row referencing a missing message was inserted")
+	}
+}
+
+func TestConvertRefusesPendingMigrations(t *testing.T) {
+	m := openManager(t)
+	migrator, err := migrations.NewMigrator(m.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Down(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Convert(context.Background(), time.Now()); err == nil || !strings.Contains(err.Error(), "pending") {
+		t.Errorf("Convert = %v, want an error about pending migrations", err)
+	}
+}
+
+func TestMaintain(t *testing.T) {
+	m := openManager(t)
+	ctx := context.Background()
+	now := time.Now()
+	if err := m.Convert(ctx, now.AddDate(0, 0, -28)); err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+
+	// A live message in an old partition keeps it attached, a message in the default partition moves to its new one
+	insert := `INSERT INTO message_queue (payload, callback_url, status, next_retry, service_name, message_type, created_at, updated_at)
+		VALUES ('{}', 'https://example.com/callback', $1, 0, 'billing', 'SCHEDULED', $2, $2)`
+	if _, err := m.db.Exec(insert, models.PENDING, now.AddDate(0, 0, -20)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.db.Exec(insert, models.COMPLETED, now); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := m.Maintain(ctx, now)
+	if err != nil {
+		t.Fatalf("Maintain: %v", err)
+	}
+	if len(result.Created) != m.cfg.Premake+1 {
+		t.Errorf("created %v, want %d partitions", result.Created, m.cfg.Premake+1)
+	}
+	if len(result.Detached) == 0 || len(result.Kept) == 0 {
+		t.Errorf("detached %v and kept %v, want both old empty and old live partitions", result.Detached, result.Kept)
+	}
+
+	var inDefault int
+	if err := m.db.QueryRow("SELECT count(*) FROM " + defaultPartition).Scan(&inDefault); err != nil {
+		t.Fatal(err)
+	}
+	if inDefault != 0 {
+		t.Errorf("%d messages left in the default partition", inDefault)
+	}
+
+	again, err := m.Maintain(ctx, now)
+	if err != nil || len(again.Created) != 0 {
+		t.Errorf("second Maintain created %v, %v, want nothing", again.Created, err)
+	}
+}
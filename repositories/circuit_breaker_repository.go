@@ -0,0 +1,81 @@
+package repositories
+
+import (
+	"schedulerV2/models"
+
+	"gorm.io/gorm"
+)
+
+type CircuitBreakerRepository struct{}
+
+func NewCircuitBreakerRepository() *CircuitBreakerRepository {
+	return &CircuitBreakerRepository{}
+}
+
+func (r *CircuitBreakerRepository) FindByHost(db *gorm.DB, host string) (*models.CircuitBreaker, error) {
+	var breaker models.CircuitBreaker
+	err := db.Table(models.CircuitBreaker.TableName(models.CircuitBreaker{})).Where("host = ?", host).First(&breaker).Error
+	if err != nil {
+		return nil, err
+	}
+	return &breaker, nil
+}
+
+func (r *CircuitBreakerRepository) FindAll(db *gorm.DB) ([]models.CircuitBreaker, error) {
+	var breakers []models.CircuitBreaker
+	err := db.Table(models.CircuitBreaker.TableName(models.CircuitBreaker{})).Order("host").Find(&breakers).Error
+	return breakers, err
+}
+
+// RecordResults atomically adds the outcomes to the counters of the host, starting a new window when the current one
+// began at or before windowFloor, and returns the updated breaker
+func (r *CircuitBreakerRepository) RecordResults(db *gorm.DB, host string, successes int64, failures int64, now int64, windowFloor int64) (*models.CircuitBreaker, error) {
+	var breaker models.CircuitBreaker
+	err := db.Raw(`INSERT INTO circuit_breaker (host, state, successes, failures, window_start, opened_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, 0, NOW(), NOW())
+		ON CONFLICT (host) DO UPDATE SET
+			successes = CASE WHEN circuit_breaker.window_start <= ? THEN EXCLUDED.successes ELSE circuit_breaker.successes + EXCLUDED.successes END,
+			failures = CASE WHEN circuit_breaker.window_start <= ? THEN EXCLUDED.failures ELSE circuit_breaker.failures + EXCLUDED.failures END,
+			window_start = CASE WHEN circuit_breaker.window_start <= ? THEN EXCLUDED.window_start ELSE circuit_breaker.window_start END,
+			updated_at = NOW()
+		RETURNING *`,
+		host, models.CircuitClosed, successes, failures, now, windowFloor, windowFloor, windowFloor).Scan(&breaker).Error
+	if err != nil {
+		return nil, err
+	}
+	return &breaker, nil
+}
+
+// Transition moves the breaker to another state, only when it is still in the expected state and was opened at the
+// expected time, so that a single replica wins each transition. It reports whether this caller won.
+func (r *CircuitBreakerRepository) Transition(db *gorm.DB, breaker *models.CircuitBreaker, to models.CircuitStateEnums, now int64) (bool, error) {
+	updates := map[string]interface{}{
+		"state":      to,
+		"opened_at":  now,
+		"updated_at": gorm.Expr("NOW()"),
+	}
+	if to == models.CircuitClosed {
+		updates["successes"] = 0
+		updates["failures"] = 0
+		updates["window_start"] = now
+		updates["opened_at"] = 0
+	}
+
+	result := db.Table(models.CircuitBreaker.TableName(models.CircuitBreaker{})).
+		Where("host = ? AND state = ? AND opened_at = ?", breaker.Host, breaker.State, breaker.OpenedAt).
+		Updates(updates)
+	return result.RowsAffected > 0, result.Error
+}
+
+// Reset closes the breaker of the host and clears its counters
+func (r *CircuitBreakerRepository) Reset(db *gorm.DB, host string, now int64) (bool, error) {
+	result := db.Table(models.CircuitBreaker.TableName(models.CircuitBreaker{})).Where("host = ?", host).Updates(map[string]interface{}{
+		"state":        models.CircuitClosed,
+		"successes":    0,
+		"failures":     0,
+		"window_start": now,
+		"opened_at":    0,
+		"updated_at":   gorm.Expr("NOW()"),
+	})
+	return result.RowsAffected > 0, result.Error
+}
@@ -1,10 +1,14 @@
 package repositories
 
 import (
+	"errors"
+	"fmt"
 	"schedulerV2/config"
 	"schedulerV2/models"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var lg = config.GetLogger(true)
@@ -27,8 +31,32 @@ func (r *MessageQueueRepository) FindByStatusAndNextRetryAndRetryCountAndIsDLQ(d
 	return messages, err
 }
 
+// ClaimDue moves up to limit due PENDING messages to IN-PROGRESS for the replica and returns them. Rows claimed by a
+// concurrent scan are skipped rather than waited on, so replicas never pick the same message.
+func (r *MessageQueueRepository) ClaimDue(db *gorm.DB, messageType models.MessageTypeEnums, retryLimit int, now int64, limit int, claimedBy string, leaseUntil int64) ([]models.MessageQueue, error) {
+	var messages []models.MessageQueue
+	err := db.Raw(`UPDATE message_queue m SET status = ?, claimed_by = ?, lease_until = ?, updated_at = now()
+		FROM (
+			SELECT id, created_at FROM message_queue
+			WHERE status = ? AND message_type = ? AND is_dlq = false AND retry_count < ? AND next_retry <= ? AND deleted_at IS NULL
+			ORDER BY next_retry
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED) due
+		WHERE `+sameMessage("due")+`
+		RETURNING m.*`,
+		models.INPROGRESS, claimedBy, leaseUntil, models.PENDING, messageType, retryLimit, now, limit).Scan(&messages).Error
+	return messages, err
+}
+
+// UpdateDeadMessageStatus reactivates the DEAD messages of the service. Of the DEAD messages sharing a dedupe key only
+// the latest is reactivated, and none when a PENDING message has the key, as the dedupe index allows one PENDING
+// message per key.
 func (r *MessageQueueRepository) UpdateDeadMessageStatus(db *gorm.DB, serviceName string, newStatus models.MessageStatusEnums) error {
 	result := db.Table(models.MessageQueue.TableName(models.MessageQueue{})).Where("service_name = ? AND status = ?", serviceName, models.DEAD).
+		Where(`dedupe_key = '' OR (
+			id = (SELECT max(d.id) FROM message_queue d WHERE d.service_name = message_queue.service_name AND d.dedupe_key = message_queue.dedupe_key AND d.status = ?)
+			AND NOT EXISTS (SELECT 1 FROM message_queue p WHERE p.service_name = message_queue.service_name AND p.dedupe_key = message_queue.dedupe_key AND p.status = ?))`,
+			models.DEAD, models.PENDING).
 		Updates(map[string]interface{}{
 			"status":      string(newStatus),
 			"retry_count": 0, // Reset retry count for reactivated messages
@@ -45,8 +73,348 @@ func (r *MessageQueueRepository) UpdateDeadMessageStatus(db *gorm.DB, serviceNam
 	return nil
 }
 
+const maxDedupeAttempts = 3
+
+// pendingDedupeConflict targets the partial unique index on (service_name, dedupe_key) for PENDING messages
+var pendingDedupeConflict = clause.OnConflict{
+	Columns:     []clause.Column{{Name: "service_name"}, {Name: "dedupe_key"}},
+	TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "status = 'PENDING' AND dedupe_key <> ''"}}},
+	DoNothing:   true,
+}
+
+// partitioned reports whether message_queue is partitioned, see schedulerV2 partition enable
+func partitioned() bool {
+	return models.AppConfig.Partitioning != nil && models.AppConfig.Partitioning.Enabled
+}
+
+// PartitionPruning narrows a statement on the message to the partition holding it, so that it does not search the id
+// index of every partition
+func PartitionPruning(message *models.MessageQueue) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if !partitioned() || message.CreatedAt.IsZero() {
+			return db
+		}
+		// The window absorbs the rounding of created_at to microseconds
+		return db.Where("created_at BETWEEN ? AND ?", message.CreatedAt.Add(-time.Second), message.CreatedAt.Add(time.Second))
+	}
+}
+
+// sameMessage joins the message_queue row m to the row of the same message in other. On a partitioned message_queue
+// the created_at match lets each lookup go to the partition of the row.
+func sameMessage(other string) string {
+	if partitioned() {
+		return "m.id = " + other + ".id AND m.created_at = " + other + ".created_at"
+	}
+	return "m.id = " + other + ".id"
+}
+
+// withDedupeLock runs fn in a transaction holding an advisory lock on the dedupe key of the message. A partitioned
+// message_queue cannot have the unique dedupe index, the lock serializes enqueues of the same key instead.
+func withDedupeLock(db *gorm.DB, message *models.MessageQueue, fn func(tx *gorm.DB) (models.EnqueueOutcomeEnums, error)) (models.EnqueueOutcomeEnums, error) {
+	var outcome models.EnqueueOutcomeEnums
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtextextended(?, 0))", message.ServiceName+"/"+message.DedupeKey).Error; err != nil {
+			return fmt.Errorf("error locking dedupe key: %v", err)
+		}
+		var err error
+		outcome, err = fn(tx)
+		return err
+	})
+	return outcome, err
+}
+
+// UpsertDebounced replaces the payload and next_retry of the PENDING message sharing the dedupe key,
+// or inserts the message when there is none. The partial unique index keeps this atomic under concurrent enqueue.
+func (r *MessageQueueRepository) UpsertDebounced(db *gorm.DB, message *models.MessageQueue) (models.EnqueueOutcomeEnums, error) {
+	if partitioned() {
+		return withDedupeLock(db, message, func(tx *gorm.DB) (models.EnqueueOutcomeEnums, error) {
+			debounced, err := debouncePending(tx, message)
+			if err != nil || debounced {
+				return models.DEBOUNCED, err
+			}
+			return models.CREATED, tx.Create(message).Error
+		})
+	}
+
+	for attempt := 0; attempt < maxDedupeAttempts; attempt++ {
+		debounced, err := debouncePending(db, message)
+		if err != nil {
+			return "", err
+		}
+		if debounced {
+			return models.DEBOUNCED, nil
+		}
+
+		result := db.Clauses(pendingDedupeConflict).Create(message)
+		if result.Error != nil {
+			return "", result.Error
+		}
+		if result.RowsAffected > 0 {
+			return models.CREATED, nil
+		}
+		// A concurrent enqueue inserted the PENDING message first, debounce onto it
+	}
+	return "", fmt.Errorf("failed to debounce message with dedupe key %s after %d attempts", message.DedupeKey, maxDedupeAttempts)
+}
+
+// debouncePending moves the payload and next_retry of the message onto the PENDING message sharing its dedupe key
+func debouncePending(db *gorm.DB, message *models.MessageQueue) (bool, error) {
+	// Payload is set so that the BeforeUpdate hook validates the incoming JSON
+	existing := models.MessageQueue{Payload: message.Payload}
+	result := db.Model(&existing).Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}}}).
+		Where("service_name = ? AND dedupe_key = ? AND status = ?", message.ServiceName, message.DedupeKey, models.PENDING).
+		Updates(map[string]interface{}{
+			"payload":      message.Payload,
+			"next_retry":   message.NextRetry,
+			"scheduled_at": message.ScheduledAt,
+			"updated_at":   time.Now(),
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	message.ID = existing.ID
+	return true, nil
+}
+
+// InsertThrottled inserts the message unless a PENDING message with the same dedupe key already exists,
+// in which case the message is dropped and the ID of the existing message is returned.
+func (r *MessageQueueRepository) InsertThrottled(db *gorm.DB, message *models.MessageQueue) (models.EnqueueOutcomeEnums, error) {
+	if partitioned() {
+		return withDedupeLock(db, message, func(tx *gorm.DB) (models.EnqueueOutcomeEnums, error) {
+			found, err := findPendingDuplicate(tx, message)
+			if err != nil || found {
+				return models.THROTTLED, err
+			}
+			return models.CREATED, tx.Create(message).Error
+		})
+	}
+
+	result := db.Clauses(pendingDedupeConflict).Create(message)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected > 0 {
+		return models.CREATED, nil
+	}
+
+	if _, err := findPendingDuplicate(db, message); err != nil {
+		return "", err
+	}
+	return models.THROTTLED, nil
+}
+
+// pendingDuplicate returns the ID of another PENDING message sharing the dedupe key of the message, 0 when there is
+// none. A debounce or throttle enqueue adds one while the message is IN-PROGRESS or DEAD.
+func pendingDuplicate(db *gorm.DB, message *models.MessageQueue) (uint, error) {
+	if message.DedupeKey == "" {
+		return 0, nil
+	}
+	var ids []uint
+	err := db.Table(models.MessageQueue.TableName(models.MessageQueue{})).Limit(1).
+		Where("service_name = ? AND dedupe_key = ? AND status = ? AND id <> ?", message.ServiceName, message.DedupeKey, models.PENDING, message.ID).
+		Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// supersededError is the last error of a message cancelled in favour of the PENDING message sharing its dedupe key
+func supersededError(duplicateID uint) string {
+	return fmt.Sprintf("superseded by PENDING message %d with the same dedupe key", duplicateID)
+}
+
+// supersedeByDuplicate cancels a message returning to PENDING when another PENDING message has its dedupe key. The
+// dedupe index allows one PENDING message per key and the newer one carries the latest enqueue.
+func supersedeByDuplicate(db *gorm.DB, message *models.MessageQueue) error {
+	if message.Status != models.PENDING {
+		return nil
+	}
+	duplicateID, err := pendingDuplicate(db, message)
+	if err != nil || duplicateID == 0 {
+		return err
+	}
+	lg.Info().Msgf("Cancelling message ID %d, PENDING message %d has its dedupe key %s", message.ID, duplicateID, message.DedupeKey)
+	message.Status = models.CANCELLED
+	message.LastError = supersededError(duplicateID)
+	return nil
+}
+
+// findPendingDuplicate sets the ID of the message to the one of the PENDING message sharing its dedupe key
+func findPendingDuplicate(db *gorm.DB, message *models.MessageQueue) (bool, error) {
+	var existing models.MessageQueue
+	err := db.Table(models.MessageQueue.TableName(models.MessageQueue{})).Select("id").Where("service_name = ? AND dedupe_key = ? AND status = ?", message.ServiceName, message.DedupeKey, models.PENDING).Take(&existing).Error
+	if err == gorm.ErrRecordNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	message.ID = existing.ID
+	return true, nil
+}
+
+// FindExpiredLeases returns IN-PROGRESS messages whose lease expired. Messages claimed before leases were recorded
+// have none, lease_until is NULL on rows older than the column, and are returned once they were not updated since
+// staleBefore.
+func (r *MessageQueueRepository) FindExpiredLeases(db *gorm.DB, now int64, staleBefore time.Time, limit int) ([]models.MessageQueue, error) {
+	var messages []models.MessageQueue
+	err := db.Table(models.MessageQueue.TableName(models.MessageQueue{})).Limit(limit).
+		Where("status = ? AND ((lease_until > 0 AND lease_until < ?) OR (COALESCE(lease_until, 0) = 0 AND updated_at < ?))", models.INPROGRESS, now, staleBefore).
+		Find(&messages).Error
+	return messages, err
+}
+
+// ReleaseExpiredLease returns the message to PENDING and counts the orphaning, unless its lease was renewed or it
+// was processed since it was read. The NULL lease columns of legacy rows were read as their zero values. The message
+// is cancelled instead when another PENDING message has its dedupe key.
+func (r *MessageQueueRepository) ReleaseExpiredLease(db *gorm.DB, message *models.MessageQueue) (bool, error) {
+	status, lastError := models.PENDING, message.LastError
+	duplicateID, err := pendingDuplicate(db, message)
+	if err != nil {
+		return false, err
+	}
+	if duplicateID != 0 {
+		status, lastError = models.CANCELLED, supersededError(duplicateID)
+	}
+
+	result := db.Table(models.MessageQueue.TableName(models.MessageQueue{})).Scopes(PartitionPruning(message)).
+		Where("id = ? AND status = ? AND COALESCE(claimed_by, '') = ? AND COALESCE(lease_until, 0) = ?", message.ID, models.INPROGRESS, message.ClaimedBy, message.LeaseUntil).
+		Updates(map[string]interface{}{
+			"status":       status,
+			"orphan_count": gorm.Expr("orphan_count + 1"),
+			"claimed_by":   "",
+			"lease_until":  0,
+			"last_error":   lastError,
+			"updated_at":   time.Now(),
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+
+	message.Status = status
+	message.LastError = lastError
+	message.OrphanCount++
+	message.ClaimedBy = ""
+	message.LeaseUntil = 0
+	return true, nil
+}
+
+// ExtendLease renews the lease of the messages that are still IN-PROGRESS and claimed by the replica
+func (r *MessageQueueRepository) ExtendLease(db *gorm.DB, messages []*models.MessageQueue, claimedBy string, leaseUntil int64) error {
+	ids := make([]uint, 0, len(messages))
+	var first, last time.Time
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+		if first.IsZero() || message.CreatedAt.Before(first) {
+			first = message.CreatedAt
+		}
+		if message.CreatedAt.After(last) {
+			last = message.CreatedAt
+		}
+	}
+
+	query := db.Table(models.MessageQueue.TableName(models.MessageQueue{})).
+		Where("id IN ? AND status = ? AND claimed_by = ?", ids, models.INPROGRESS, claimedBy)
+	if partitioned() && !first.IsZero() {
+		// The window absorbs the rounding of created_at to microseconds, see PartitionPruning
+		query = query.Where("created_at BETWEEN ? AND ?", first.Add(-time.Second), last.Add(time.Second))
+	}
+	return query.Update("lease_until", leaseUntil).Error
+}
+
+// ErrAlreadyInDLQ is returned by MoveToDLQ when another replica moved the message first
+var ErrAlreadyInDLQ = errors.New("message is already in the DLQ")
+
+// MoveToDLQ flags the message as DLQ and records it in the DLQ table within a single transaction
+func (r *MessageQueueRepository) MoveToDLQ(db *gorm.DB, message *models.MessageQueue) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Flagging the row first makes concurrent moves of the same message wait for each other, only one records it
+		result := tx.Table(models.MessageQueue.TableName(models.MessageQueue{})).Scopes(PartitionPruning(message)).Where("id = ? AND is_dlq = ?", message.ID, false).Update("is_dlq", true)
+		if result.Error != nil {
+			return fmt.Errorf("error flagging message as DLQ: %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrAlreadyInDLQ
+		}
+
+		dlqMessage := models.DlqMessageQueue{MessageID: message.ID, IsProcessed: false}
+		if err := tx.Create(&dlqMessage).Error; err != nil {
+			return fmt.Errorf("error saving DLQ message: %v", err)
+		}
+
+		message.IsDLQ = true
+		if err := saveMessage(tx, message); err != nil {
+			return fmt.Errorf("error updating message status: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		message.IsDLQ = false
+	}
+	return err
+}
+
+// FindByIDAndServiceName returns the message only when it belongs to the service
+func (r *MessageQueueRepository) FindByIDAndServiceName(db *gorm.DB, id uint, serviceName string) (*models.MessageQueue, error) {
+	var message models.MessageQueue
+	err := db.Table(models.MessageQueue.TableName(models.MessageQueue{})).Where("id = ? AND service_name = ?", id, serviceName).Take(&message).Error
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// FindPendingNotifications returns messages whose terminal state notification is due
+func (r *MessageQueueRepository) FindPendingNotifications(db *gorm.DB, now int64, limit int) ([]models.MessageQueue, error) {
+	var messages []models.MessageQueue
+	err := db.Table(models.MessageQueue.TableName(models.MessageQueue{})).Limit(limit).Where("notification_status = ? AND notify_at <= ?", models.NotificationPending, now).Find(&messages).Error
+	return messages, err
+}
+
+// ClaimNotification moves notify_at of a pending notification to leaseUntil, so that other replicas skip it while it
+// is sent. It reports false when another replica claimed it first.
+func (r *MessageQueueRepository) ClaimNotification(db *gorm.DB, message *models.MessageQueue, leaseUntil int64) (bool, error) {
+	result := db.Table(models.MessageQueue.TableName(models.MessageQueue{})).Scopes(PartitionPruning(message)).
+		Where("id = ? AND notification_status = ? AND notify_at = ?", message.ID, models.NotificationPending, message.NotifyAt).
+		Update("notify_at", leaseUntil)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	message.NotifyAt = leaseUntil
+	return true, nil
+}
+
+// UpdateNotification saves the notification columns only, leaving the rest of the message untouched
+func (r *MessageQueueRepository) UpdateNotification(db *gorm.DB, message *models.MessageQueue) error {
+	return db.Table(models.MessageQueue.TableName(models.MessageQueue{})).Scopes(PartitionPruning(message)).Where("id = ?", message.ID).
+		Updates(map[string]interface{}{
+			"notification_status": message.NotificationStatus,
+			"notify_at":           message.NotifyAt,
+			"notify_attempts":     message.NotifyAttempts,
+		}).Error
+}
+
+// Save inserts a new message and writes a stored one. A message returning to PENDING is cancelled instead when another
+// PENDING message has its dedupe key, see supersedeByDuplicate.
 func (r *MessageQueueRepository) Save(db *gorm.DB, message *models.MessageQueue) error {
-	return db.Save(message).Error
+	if message.ID == 0 {
+		return db.Create(message).Error
+	}
+	if err := supersedeByDuplicate(db, message); err != nil {
+		return err
+	}
+	return saveMessage(db, message)
+}
+
+// saveMessage writes every column of a stored message but created_at, which is the partition key. Unlike gorm Save it
+// never falls back to an INSERT ... ON CONFLICT (id) when no row matched, which the (id, created_at) primary key of
+// a partitioned message_queue rejects.
+func saveMessage(db *gorm.DB, message *models.MessageQueue) error {
+	return db.Model(message).Scopes(PartitionPruning(message)).Select("*").Omit("created_at").Updates(message).Error
 }
 
 func (r *MessageQueueRepository) Ping(db *gorm.DB) error {
@@ -0,0 +1,461 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"schedulerV2/migrations/migrationstest"
+	"schedulerV2/models"
+	"schedulerV2/partitioning"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func newDedupeMessage(dedupeKey string, mode models.DedupeModeEnums, nextRetry int64, payload string) *models.MessageQueue {
+	return &models.MessageQueue{
+		Payload:     json.RawMessage(payload),
+		CallbackUrl: "https://example.com/callback",
+		NextRetry:   nextRetry,
+		ServiceName: "billing",
+		MessageType: models.SCHEDULED,
+		DedupeKey:   dedupeKey,
+		DedupeMode:  mode,
+	}
+}
+
+func countPending(t *testing.T, db *gorm.DB, dedupeKey string) int64 {
+	t.Helper()
+	var count int64
+	if err := db.Model(&models.MessageQueue{}).Where("dedupe_key = ? AND status = ?", dedupeKey, models.PENDING).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestUpsertDebounced(t *testing.T) {
+	db := migrationstest.Open(t)
+	r := NewMessageQueueRepository()
+
+	first := newDedupeMessage("order-1", models.DEBOUNCE, 100, `{"v": 1}`)
+	if outcome, err := r.UpsertDebounced(db, first); err != nil || outcome != models.CREATED {
+		t.Fatalf("first enqueue: got %s, %v, want CREATED", outcome, err)
+	}
+
+	second := newDedupeMessage("order-1", models.DEBOUNCE, 200, `{"v": 2}`)
+	if outcome, err := r.UpsertDebounced(db, second); err != nil || outcome != models.DEBOUNCED {
+		t.Fatalf("second enqueue: got %s, %v, want DEBOUNCED", outcome, err)
+	}
+	if second.ID != first.ID {
+		t.Fatalf("debounced onto message %d, want %d", second.ID, first.ID)
+	}
+
+	var stored models.MessageQueue
+	if err := db.First(&stored, first.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.NextRetry != 200 || string(stored.Payload) != `{"v": 2}` {
+		t.Errorf("stored next_retry %d payload %s, want the ones of the last enqueue", stored.NextRetry, stored.Payload)
+	}
+
+	other := newDedupeMessage("order-2", models.DEBOUNCE, 100, `{}`)
+	if outcome, err := r.UpsertDebounced(db, other); err != nil || outcome != models.CREATED || other.ID == first.ID {
+		t.Errorf("other key: got %s, %v, id %d, want a new message", outcome, err, other.ID)
+	}
+
+	// A message no longer PENDING does not absorb new enqueues
+	if err := db.Model(&stored).Update("status", models.COMPLETED).Error; err != nil {
+		t.Fatal(err)
+	}
+	third := newDedupeMessage("order-1", models.DEBOUNCE, 300, `{}`)
+	if outcome, err := r.UpsertDebounced(db, third); err != nil || outcome != models.CREATED || third.ID == first.ID {
+		t.Errorf("after completion: got %s, %v, id %d, want a new message", outcome, err, third.ID)
+	}
+}
+
+func TestInsertThrottled(t *testing.T) {
+	db := migrationstest.Open(t)
+	r := NewMessageQueueRepository()
+
+	first := newDedupeMessage("report-1", models.THROTTLE, 100, `{"v": 1}`)
+	if outcome, err := r.InsertThrottled(db, first); err != nil || outcome != models.CREATED {
+		t.Fatalf("first enqueue: got %s, %v, want CREATED", outcome, err)
+	}
+
+	second := newDedupeMessage("report-1", models.THROTTLE, 200, `{"v": 2}`)
+	if outcome, err := r.InsertThrottled(db, second); err != nil || outcome != models.THROTTLED {
+		t.Fatalf("second enqueue: got %s, %v, want THROTTLED", outcome, err)
+	}
+	if second.ID != first.ID {
+		t.Errorf("throttled onto message %d, want %d", second.ID, first.ID)
+	}
+
+	var stored models.MessageQueue
+	if err := db.First(&stored, first.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.NextRetry != 100 || string(stored.Payload) != `{"v": 1}` {
+		t.Errorf("stored next_retry %d payload %s, want the first enqueue untouched", stored.NextRetry, stored.Payload)
+	}
+}
+
+func TestDedupeConcurrentEnqueues(t *testing.T) {
+	db := migrationstest.Open(t)
+	r := NewMessageQueueRepository()
+	const enqueues = 20
+
+	tests := []struct {
+		mode    models.DedupeModeEnums
+		enqueue func(*gorm.DB, *models.MessageQueue) (models.EnqueueOutcomeEnums, error)
+		repeat  models.EnqueueOutcomeEnums
+	}{
+		{models.DEBOUNCE, r.UpsertDebounced, models.DEBOUNCED},
+		{models.THROTTLE, r.InsertThrottled, models.THROTTLED},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			dedupeKey := "concurrent-" + string(tt.mode)
+			outcomes := make(chan models.EnqueueOutcomeEnums, enqueues)
+			var wg sync.WaitGroup
+			for i := 0; i < enqueues; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					outcome, err := tt.enqueue(db, newDedupeMessage(dedupeKey, tt.mode, int64(100+i), fmt.Sprintf(`{"i": %d}`, i)))
+					if err != nil {
+						t.Errorf("enqueue %d: %v", i, err)
+					}
+					outcomes <- outcome
+				}(i)
+			}
+			wg.Wait()
+			close(outcomes)
+
+			created := 0
+			for outcome := range outcomes {
+				switch outcome {
+				case models.CREATED:
+					created++
+				case tt.repeat:
+				default:
+					t.Errorf("unexpected outcome %q", outcome)
+				}
+			}
+			if created != 1 {
+				t.Errorf("%d enqueues created a message, want 1", created)
+			}
+			if pending := countPending(t, db, dedupeKey); pending != 1 {
+				t.Errorf("%d PENDING messages share the dedupe key, want 1", pending)
+			}
+		})
+	}
+}
+
+func TestReleaseExpiredLeaseOfLegacyRow(t *testing.T) {
+	db := migrationstest.Open(t)
+	r := NewMessageQueueRepository()
+	now := time.Now()
+
+	// Rows claimed before leases were recorded have NULL lease columns
+	var legacyID, freshID, leasedID uint
+	insert := `INSERT INTO message_queue (payload, callback_url, status, next_retry, service_name, message_type, created_at, updated_at, claimed_by, lease_until)
+		VALUES ('{}', 'https://example.com/callback', 'IN-PROGRESS', 0, 'billing', 'SCHEDULED', ?, ?, ?, ?) RETURNING id`
+	if err := db.Raw(insert, now, now.Add(-time.Hour), nil, nil).Scan(&legacyID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Raw(insert, now, now, nil, nil).Scan(&freshID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Raw(insert, now, now.Add(-time.Hour), "replica-1", now.Add(time.Minute).Unix()).Scan(&leasedID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := r.FindExpiredLeases(db, now.Unix(), now.Add(-time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].ID != legacyID {
+		ids := make([]uint, 0, len(expired))
+		for _, message := range expired {
+			ids = append(ids, message.ID)
+		}
+		t.Fatalf("expired leases %v, want only the stale legacy message %d (fresh %d, leased %d)", ids, legacyID, freshID, leasedID)
+	}
+
+	released, err := r.ReleaseExpiredLease(db, &expired[0])
+	if err != nil || !released {
+		t.Fatalf("ReleaseExpiredLease = %v, %v, want the legacy message released", released, err)
+	}
+	var stored models.MessageQueue
+	if err := db.First(&stored, legacyID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != models.PENDING || stored.OrphanCount != 1 {
+		t.Errorf("legacy message is %s with %d orphanings, want PENDING with 1", stored.Status, stored.OrphanCount)
+	}
+}
+
+// withPartitioning enables partitioning in the config for the duration of the test
+func withPartitioning(t *testing.T) *models.PartitioningConfig {
+	t.Helper()
+	previous := models.AppConfig.Partitioning
+	cfg := &models.PartitioningConfig{Enabled: true, Key: models.PartitionByCreatedAt, Days: 7, Premake: 2}
+	models.AppConfig.Partitioning = cfg
+	t.Cleanup(func() { models.AppConfig.Partitioning = previous })
+	return cfg
+}
+
+// openPartitioned opens a test schema whose message_queue is partitioned by created_at
+func openPartitioned(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := migrationstest.Open(t)
+	cfg := withPartitioning(t)
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := partitioning.NewManager(sqlDB, *cfg).Convert(context.Background(), time.Now()); err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	return db
+}
+
+// dryRun returns a connection that only builds statements, recording the inserts and updates it would run
+func dryRun(t *testing.T) (*gorm.DB, *[]string) {
+	t.Helper()
+	db, err := gorm.Open(postgres.Open(""), &gorm.Config{DryRun: true, SkipDefaultTransaction: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var statements []string
+	record := func(tx *gorm.DB) { statements = append(statements, tx.Statement.SQL.String()) }
+	db.Callback().Update().After("gorm:update").Register("test:record", record)
+	db.Callback().Create().After("gorm:create").Register("test:record", record)
+	return db, &statements
+}
+
+func TestSaveMessageStatement(t *testing.T) {
+	withPartitioning(t)
+	db, recorded := dryRun(t)
+
+	message := &models.MessageQueue{Payload: json.RawMessage(`{}`)}
+	message.ID = 7
+	message.CreatedAt = time.Now()
+	if err := saveMessage(db, message); err != nil {
+		t.Fatal(err)
+	}
+	statements := *recorded
+	if len(statements) != 1 {
+		t.Fatalf("saving a message runs %q, want one statement", statements)
+	}
+
+	sql := statements[0]
+	set, where, _ := strings.Cut(sql, " WHERE ")
+	if !strings.HasPrefix(sql, "UPDATE ") || strings.Contains(sql, "ON CONFLICT") {
+		t.Errorf("saving a message runs %s, want a plain UPDATE", sql)
+	}
+	if strings.Contains(set, "created_at") {
+		t.Errorf("saving a message writes the partition key: %s", set)
+	}
+	if !strings.Contains(where, "created_at BETWEEN") || !strings.Contains(where, `"id" =`) {
+		t.Errorf("saving a message is not narrowed to its partition: %s", where)
+	}
+}
+
+func TestSaveNewMessageInserts(t *testing.T) {
+	db, statements := dryRun(t)
+
+	message := &models.MessageQueue{Payload: json.RawMessage(`{}`), CallbackUrl: "https://example.com/callback", Status: models.PENDING}
+	if err := NewMessageQueueRepository().Save(db, message); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if len(*statements) != 1 || !strings.HasPrefix((*statements)[0], "INSERT INTO ") {
+		t.Errorf("saving a new message runs %q, want one INSERT", *statements)
+	}
+}
+
+func TestPartitionedMessageQueue(t *testing.T) {
+	db := openPartitioned(t)
+	r := NewMessageQueueRepository()
+	now := time.Now().Unix()
+
+	message := &models.MessageQueue{
+		Payload:     json.RawMessage(`{}`),
+		CallbackUrl: "https://example.com/callback",
+		NextRetry:   now - 1,
+		ServiceName: "billing",
+		MessageType: models.SCHEDULED,
+	}
+	if err := db.Create(message).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := r.ClaimDue(db, models.SCHEDULED, 5, now, 10, "replica-1", now+60)
+	if err != nil {
+		t.Fatalf("ClaimDue: %v", err)
+	}
+	if len(claimed) != 1 || claimed[0].ID != message.ID || claimed[0].Status != models.INPROGRESS || claimed[0].CreatedAt.IsZero() {
+		t.Fatalf("ClaimDue returned %+v, want message %d IN-PROGRESS", claimed, message.ID)
+	}
+	message = &claimed[0]
+
+	if err := r.ExtendLease(db, []*models.MessageQueue{message}, "replica-1", now+120); err != nil {
+		t.Fatalf("ExtendLease: %v", err)
+	}
+	stored := storedMessage(t, db, message.ID)
+	if stored.LeaseUntil != now+120 {
+		t.Errorf("lease until %d after ExtendLease, want %d", stored.LeaseUntil, now+120)
+	}
+
+	// A retry far ahead must update the row in place
+	message.Status = models.PENDING
+	message.RetryCount++
+	message.NextRetry = now + 60*24*60*60
+	if err := r.Save(db, message); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	stored = storedMessage(t, db, message.ID)
+	if stored.Status != models.PENDING || stored.RetryCount != 1 || stored.NextRetry != message.NextRetry {
+		t.Errorf("saved message is %s with %d retries at %d, want PENDING with 1 at %d", stored.Status, stored.RetryCount, stored.NextRetry, message.NextRetry)
+	}
+	if !stored.CreatedAt.Equal(message.CreatedAt) {
+		t.Errorf("Save changed created_at from %v to %v", message.CreatedAt, stored.CreatedAt)
+	}
+
+	message.NotificationStatus = models.NotificationPending
+	message.NotifyAt = now
+	if err := r.UpdateNotification(db, message); err != nil {
+		t.Fatalf("UpdateNotification: %v", err)
+	}
+	if claimed, err := r.ClaimNotification(db, message, now+30); err != nil || !claimed {
+		t.Fatalf("ClaimNotification = %v, %v, want the notification claimed", claimed, err)
+	}
+
+	if err := r.MoveToDLQ(db, message); err != nil {
+		t.Fatalf("MoveToDLQ: %v", err)
+	}
+	if err := r.MoveToDLQ(db, message); err != ErrAlreadyInDLQ {
+		t.Errorf("second MoveToDLQ = %v, want ErrAlreadyInDLQ", err)
+	}
+	var dlqCount int64
+	if err := db.Model(&models.DlqMessageQueue{}).Where("message_id = ?", message.ID).Count(&dlqCount).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored := storedMessage(t, db, message.ID); !stored.IsDLQ || dlqCount != 1 {
+		t.Errorf("message is_dlq %v with %d DLQ rows, want true with 1", stored.IsDLQ, dlqCount)
+	}
+
+	// The foreign key of the DLQ table is replaced by a trigger
+	if err := db.Create(&models.DlqMessageQueue{MessageID: message.ID + 1000}).Error; err == nil {
+		t.Error("DLQ row referencing a missing message was inserted")
+	}
+
+	// Saving a message whose row is gone must not insert it again
+	for _, table := range []string{"dlq_message_queue", "message_queue"} {
+		if err := db.Exec("DELETE FROM " + table).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Save(db, message); err != nil {
+		t.Fatalf("Save of a deleted message: %v", err)
+	}
+	var count int64
+	if err := db.Model(&models.MessageQueue{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("Save of a deleted message inserted %d rows", count)
+	}
+}
+
+func storedMessage(t *testing.T, db *gorm.DB, id uint) models.MessageQueue {
+	t.Helper()
+	var stored models.MessageQueue
+	if err := db.First(&stored, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestReturnToPendingWithPendingDuplicate(t *testing.T) {
+	db := migrationstest.Open(t)
+	r := NewMessageQueueRepository()
+	now := time.Now().Unix()
+
+	// The original was IN-PROGRESS when a new enqueue of its key created a PENDING message
+	saved := newDedupeMessage("order-1", models.DEBOUNCE, now, `{"v": 1}`)
+	saved.Status = models.INPROGRESS
+	released := newDedupeMessage("order-2", models.DEBOUNCE, now, `{"v": 1}`)
+	released.Status = models.INPROGRESS
+	released.ClaimedBy = "replica-1"
+	released.LeaseUntil = now - 1
+	unrelated := newDedupeMessage("order-3", models.DEBOUNCE, now, `{"v": 1}`)
+	unrelated.Status = models.INPROGRESS
+	for _, message := range []*models.MessageQueue{saved, released, unrelated,
+		newDedupeMessage("order-1", models.DEBOUNCE, now+60, `{"v": 2}`),
+		newDedupeMessage("order-2", models.DEBOUNCE, now+60, `{"v": 2}`)} {
+		if err := db.Create(message).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved.Status = models.PENDING
+	if err := r.Save(db, saved); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if stored := storedMessage(t, db, saved.ID); stored.Status != models.CANCELLED || !strings.HasPrefix(stored.LastError, "superseded") {
+		t.Errorf("saved message is %s (%s), want CANCELLED as superseded", stored.Status, stored.LastError)
+	}
+
+	if ok, err := r.ReleaseExpiredLease(db, released); err != nil || !ok {
+		t.Fatalf("ReleaseExpiredLease = %v, %v", ok, err)
+	}
+	if stored := storedMessage(t, db, released.ID); stored.Status != models.CANCELLED || released.Status != models.CANCELLED {
+		t.Errorf("released message is %s, want CANCELLED", stored.Status)
+	}
+
+	unrelated.Status = models.PENDING
+	if err := r.Save(db, unrelated); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if stored := storedMessage(t, db, unrelated.ID); stored.Status != models.PENDING {
+		t.Errorf("message without a duplicate is %s, want PENDING", stored.Status)
+	}
+}
+
+func TestUpdateDeadMessageStatusKeepsOnePendingPerKey(t *testing.T) {
+	db := migrationstest.Open(t)
+	r := NewMessageQueueRepository()
+
+	dead := func(dedupeKey string) *models.MessageQueue {
+		message := newDedupeMessage(dedupeKey, models.DEBOUNCE, 0, `{}`)
+		message.Status = models.DEAD
+		if err := db.Create(message).Error; err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+	older, latest := dead("order-1"), dead("order-1")
+	shadowed := dead("order-2")
+	if err := db.Create(newDedupeMessage("order-2", models.DEBOUNCE, 0, `{}`)).Error; err != nil {
+		t.Fatal(err)
+	}
+	plain := dead("")
+
+	if err := r.UpdateDeadMessageStatus(db, "billing", models.PENDING); err != nil {
+		t.Fatalf("UpdateDeadMessageStatus: %v", err)
+	}
+	for _, test := range []struct {
+		message *models.MessageQueue
+		want    models.MessageStatusEnums
+	}{{older, models.DEAD}, {latest, models.PENDING}, {shadowed, models.DEAD}, {plain, models.PENDING}} {
+		if stored := storedMessage(t, db, test.message.ID); stored.Status != test.want {
+			t.Errorf("message %d with key %q is %s, want %s", test.message.ID, test.message.DedupeKey, stored.Status, test.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package repositories
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// finishedMessages selects up to limit terminal messages last updated before the cutoff. DLQ messages are kept for
+// the DLQ table and messages with a notification still to send are kept until it is sent.
+const finishedMessages = `SELECT id, created_at FROM message_queue
+	WHERE status IN ('COMPLETED', 'CANCELLED', 'DEAD') AND is_dlq = false AND updated_at < @before
+		AND (notification_status IS NULL OR notification_status <> 'PENDING') AND %s
+	ORDER BY updated_at
+	LIMIT @limit
+	FOR UPDATE SKIP LOCKED`
+
+// RetentionScope restricts a retention batch to one service, or to every service but the excluded ones
+type RetentionScope struct {
+	ServiceName string
+	Excluded    []string
+}
+
+func (s RetentionScope) clause() (string, map[string]interface{}) {
+	if s.ServiceName != "" {
+		return "service_name = @service", map[string]interface{}{"service": s.ServiceName}
+	}
+	if len(s.Excluded) > 0 {
+		return "service_name NOT IN @excluded", map[string]interface{}{"excluded": s.Excluded}
+	}
+	return "true", map[string]interface{}{}
+}
+
+type RetentionRepository struct{}
+
+func NewRetentionRepository() *RetentionRepository {
+	return &RetentionRepository{}
+}
+
+// ArchiveFinished moves a batch of terminal messages of the scope into message_queue_archive and returns how many
+// it moved
+func (r *RetentionRepository) ArchiveFinished(db *gorm.DB, scope RetentionScope, before time.Time, limit int) (int64, error) {
+	where, args := scope.clause()
+	args["before"] = before
+	args["limit"] = limit
+
+	query := fmt.Sprintf(`WITH batch AS (`+finishedMessages+`),
+		moved AS (DELETE FROM message_queue m USING batch WHERE `+sameMessage("batch")+` RETURNING m.*)
+		INSERT INTO message_queue_archive SELECT *, now() FROM moved`, where)
+	result := db.Exec(query, args)
+	return result.RowsAffected, result.Error
+}
+
+// DeleteFinished deletes a batch of terminal messages of the scope and returns how many it deleted
+func (r *RetentionRepository) DeleteFinished(db *gorm.DB, scope RetentionScope, before time.Time, limit int) (int64, error) {
+	where, args := scope.clause()
+	args["before"] = before
+	args["limit"] = limit
+
+	query := fmt.Sprintf(`WITH batch AS (`+finishedMessages+`)
+		DELETE FROM message_queue m USING batch WHERE `+sameMessage("batch"), where)
+	result := db.Exec(query, args)
+	return result.RowsAffected, result.Error
+}
@@ -1,6 +1,7 @@
 package routers
 
 import (
+	"expvar"
 	"net/http"
 	"schedulerV2/config"
 	"schedulerV2/controllers"
@@ -13,7 +14,15 @@ import (
 func SetupRouter(schedulerV2 *gin.RouterGroup) {
 	gin.Recovery()
 	schedulerV2.POST("/api/message", controllers.EnqueueMessage)
+	schedulerV2.GET("/api/message/:id/result", controllers.GetMessageResult)
 	schedulerV2.PATCH("service/threshold", controllers.UpdateServiceThreshold)
+	schedulerV2.GET("/admin/circuit-breakers", controllers.GetCircuitBreakers)
+	schedulerV2.POST("/admin/circuit-breakers/:host/reset", controllers.ResetCircuitBreaker)
+}
+
+// Metrics exposes the expvar counters, including the callback transport connection metrics
+func Metrics(c *gin.Context) {
+	expvar.Handler().ServeHTTP(c.Writer, c.Request)
 }
 
 // healthCheck defines the health check route handler
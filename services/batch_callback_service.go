@@ -0,0 +1,209 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"schedulerV2/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// groupByCallbackEndpoint groups batch enabled messages by service, callback URL, TLS profile and user, preserving
+// scan order. The user is part of the key as the internal token of a request is issued for a single user.
+func groupByCallbackEndpoint(messages []models.MessageQueue) [][]models.MessageQueue {
+	var groups [][]models.MessageQueue
+	index := make(map[string]int)
+
+	for _, message := range messages {
+		key := message.ServiceName + "|" + message.CallbackUrl + "|" + message.TLSProfile + "|" + message.UserId
+		i, found := index[key]
+		if !found {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], message)
+	}
+	return groups
+}
+
+// processScheduledBatch claims the messages of a single callback endpoint and delivers them as JSON arrays
+// bounded by the configured item and byte limits. Every message is then completed or retried individually.
+func processScheduledBatch(db *gorm.DB, group []models.MessageQueue) {
+	var claimed []*models.MessageQueue
+	var releases []func()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+
+	for i := range group {
+		msg := &group[i]
+		release, ok := claimScheduledMessage(db, msg)
+		if !ok {
+			continue
+		}
+		claimed = append(claimed, msg)
+		releases = append(releases, release)
+	}
+
+	host := callbackHost(group[0].CallbackUrl)
+	for i, chunk := range chunkBatch(dropExpired(db, claimed)) {
+		if i > 0 {
+			extendLeases(db, chunk)
+			// Earlier chunks took time, messages of this one may have expired since
+			if chunk = dropExpired(db, chunk); len(chunk) == 0 {
+				continue
+			}
+		}
+
+		allowed, probe, deferUntil := allowCallback(db, host)
+		if !allowed {
+			for _, msg := range chunk {
+				if err := deferMessage(db, msg, deferUntil); err != nil {
+					lg.Error().Msgf("Error deferring message ID %d: %v", msg.ID, err)
+				}
+			}
+			continue
+		}
+
+		results, err := sendBatchCallback(chunk)
+		recordCallbackResult(db, host, probe, err)
+		for _, msg := range chunk {
+			var applyErr error
+			if err != nil {
+				applyErr = applyScheduledCallbackResult(db, msg, nil, err)
+			} else if data, found := results[msg.ID]; found {
+				applyErr = applyScheduledCallbackResult(db, msg, &data, nil)
+			} else {
+				applyErr = applyScheduledCallbackResult(db, msg, nil, fmt.Errorf("batch callback returned no status for message ID %d", msg.ID))
+			}
+
+			if applyErr != nil {
+				lg.Error().Msgf("Error processing message ID %d: %v", msg.ID, applyErr)
+				msg.Status = models.PENDING
+				messageQueueRepository.Save(db, msg)
+			}
+		}
+	}
+}
+
+// dropExpired moves the messages past their delivery deadline to the DLQ, like processScheduledMessage, and returns
+// the others. A batch request is bounded by the earliest deadline of its messages, so an expired message would expire
+// the request of every message sent with it.
+func dropExpired(db *gorm.DB, messages []*models.MessageQueue) []*models.MessageQueue {
+	now := time.Now().Unix()
+	kept := make([]*models.MessageQueue, 0, len(messages))
+	for _, msg := range messages {
+		if !deliveryDeadlinePassed(msg, now) {
+			kept = append(kept, msg)
+			continue
+		}
+		if err := moveToDLQAfterDeadline(db, msg); err != nil {
+			lg.Error().Msgf("Error moving message ID %d to the DLQ: %v", msg.ID, err)
+		}
+	}
+	return kept
+}
+
+// chunkBatch splits messages into chunks of at most CallbackBatchMaxItems items and CallbackBatchMaxBytes payload bytes.
+// A single message larger than the byte limit is still sent on its own.
+func chunkBatch(messages []*models.MessageQueue) [][]*models.MessageQueue {
+	var chunks [][]*models.MessageQueue
+	var current []*models.MessageQueue
+	currentBytes := 0
+
+	for _, msg := range messages {
+		size := len(msg.Payload)
+		if len(current) > 0 && (len(current) >= models.AppConfig.CallbackBatchMaxItems || currentBytes+size > models.AppConfig.CallbackBatchMaxBytes) {
+			chunks = append(chunks, current)
+			current = nil
+			currentBytes = 0
+		}
+		current = append(current, msg)
+		currentBytes += size
+	}
+
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// sendBatchCallback POSTs the chunk as one JSON array and returns the statuses keyed by message ID
+func sendBatchCallback(chunk []*models.MessageQueue) (results map[uint]models.Data, err error) {
+	ctx, span := startBatchDispatchSpan(chunk)
+	defer func() { endDispatchSpan(span, err) }()
+
+	items := make([]models.BatchCallbackRequestItem, 0, len(chunk))
+	for _, msg := range chunk {
+		delivery := newDeliveryContext(msg)
+		payload, err := deliveryPayload(msg, delivery)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, models.BatchCallbackRequestItem{
+			ID:          msg.ID,
+			UserId:      msg.UserId,
+			Attempt:     delivery.Attempt,
+			ScheduledAt: delivery.ScheduledAt,
+			Payload:     payload,
+		})
+	}
+
+	requestBody, err := json.Marshal(items)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling batch payload: %v", err)
+	}
+
+	lg.Info().Msgf("Sending batch of %d messages to %s", len(chunk), chunk[0].CallbackUrl)
+
+	var response models.BatchCallbackResponseDTO
+	emptySuccess, err := doCallback(ctx, batchCallbackRequest(chunk, requestBody), &response)
+	if err != nil {
+		return nil, err
+	}
+
+	// A 2xx response without a body acknowledges every message of the chunk
+	if emptySuccess {
+		results = make(map[uint]models.Data, len(chunk))
+		for _, msg := range chunk {
+			results[msg.ID] = models.Data{Status: StatusSuccess}
+		}
+		return results, nil
+	}
+
+	results = make(map[uint]models.Data, len(response.Data))
+	for _, item := range response.Data {
+		results[item.ID] = item.Data
+	}
+	return results, nil
+}
+
+// batchCallbackRequest builds the request of a chunk, bounded by the shortest timeout and the earliest delivery
+// deadline of its messages so that none is sent later than it allows
+func batchCallbackRequest(chunk []*models.MessageQueue, body []byte) callbackRequest {
+	first := chunk[0]
+	request := callbackRequest{
+		Method:      http.MethodPost,
+		Url:         first.CallbackUrl,
+		ServiceName: first.ServiceName,
+		UserId:      first.UserId,
+		Body:        body,
+		Timeout:     callbackTimeout(first),
+		Deadline:    deliveryDeadline(first),
+		TLSProfile:  first.TLSProfile,
+	}
+	for _, msg := range chunk[1:] {
+		if timeout := callbackTimeout(msg); timeout < request.Timeout {
+			request.Timeout = timeout
+		}
+		if deadline := deliveryDeadline(msg); !deadline.IsZero() && (request.Deadline.IsZero() || deadline.Before(request.Deadline)) {
+			request.Deadline = deadline
+		}
+	}
+	return request
+}
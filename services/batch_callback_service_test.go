@@ -0,0 +1,207 @@
+package services
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"schedulerV2/migrations/migrationstest"
+	"schedulerV2/models"
+	"schedulerV2/repositories"
+	"strings"
+	"testing"
+	"time"
+)
+
+func batchMessage(id uint, serviceName, callbackUrl, userId string, payloadBytes int) models.MessageQueue {
+	message := models.MessageQueue{
+		CallbackUrl:   callbackUrl,
+		ServiceName:   serviceName,
+		UserId:        userId,
+		MessageType:   models.SCHEDULED,
+		BatchCallback: true,
+		// A JSON string of payloadBytes bytes, quotes included
+		Payload: json.RawMessage(`"` + strings.Repeat("x", payloadBytes-2) + `"`),
+	}
+	message.ID = id
+	return message
+}
+
+func groupIDs(group []models.MessageQueue) []uint {
+	var result []uint
+	for _, message := range group {
+		result = append(result, message.ID)
+	}
+	return result
+}
+
+func chunkIDs(chunk []*models.MessageQueue) []uint {
+	var result []uint
+	for _, message := range chunk {
+		result = append(result, message.ID)
+	}
+	return result
+}
+
+func TestGroupByCallbackEndpoint(t *testing.T) {
+	messages := []models.MessageQueue{
+		batchMessage(1, "billing", "https://a.example.com/hook", "u1", 10),
+		batchMessage(2, "billing", "https://b.example.com/hook", "u1", 10),
+		batchMessage(3, "billing", "https://a.example.com/hook", "u1", 10),
+		batchMessage(4, "reports", "https://a.example.com/hook", "u1", 10),
+		batchMessage(5, "billing", "https://a.example.com/hook", "u2", 10),
+		batchMessage(6, "billing", "https://a.example.com/hook", "u1", 10),
+	}
+	messages[5].TLSProfile = "partner"
+
+	groups := groupByCallbackEndpoint(messages)
+	want := [][]uint{{1, 3}, {2}, {4}, {5}, {6}}
+	if len(groups) != len(want) {
+		t.Fatalf("got %d groups, want %d", len(groups), len(want))
+	}
+	for i, group := range groups {
+		if got := groupIDs(group); !equalIDs(got, want[i]) {
+			t.Errorf("group %d holds %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+func TestChunkBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxItems int
+		maxBytes int
+		sizes    []int
+		want     [][]uint
+	}{
+		{"within limits", 10, 1000, []int{10, 10, 10}, [][]uint{{1, 2, 3}}},
+		{"item limit", 2, 1000, []int{10, 10, 10, 10, 10}, [][]uint{{1, 2}, {3, 4}, {5}}},
+		{"byte limit", 10, 25, []int{10, 10, 10, 10}, [][]uint{{1, 2}, {3, 4}}},
+		{"exact byte limit", 10, 20, []int{10, 10, 10}, [][]uint{{1, 2}, {3}}},
+		{"oversized message alone", 10, 25, []int{10, 40, 10}, [][]uint{{1}, {2}, {3}}},
+		{"empty", 10, 25, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAppConfig(t, models.Config{CallbackBatchMaxItems: tt.maxItems, CallbackBatchMaxBytes: tt.maxBytes})
+
+			var messages []*models.MessageQueue
+			for i, size := range tt.sizes {
+				message := batchMessage(uint(i+1), "billing", "https://a.example.com/hook", "u1", size)
+				messages = append(messages, &message)
+			}
+
+			chunks := chunkBatch(messages)
+			if len(chunks) != len(tt.want) {
+				t.Fatalf("got %d chunks, want %d", len(chunks), len(tt.want))
+			}
+			for i, chunk := range chunks {
+				if got := chunkIDs(chunk); !equalIDs(got, tt.want[i]) {
+					t.Errorf("chunk %d holds %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBatchCallbackRequest(t *testing.T) {
+	withAppConfig(t, models.Config{CallbackTimeoutDefault: 30, CallbackTimeoutMax: 60})
+
+	first := batchMessage(1, "billing", "https://a.example.com/hook", "u1", 10)
+	first.DeliveryDeadline = 2000
+	second := batchMessage(2, "billing", "https://a.example.com/hook", "u1", 10)
+	second.CallbackTimeout = 10
+	second.DeliveryDeadline = 1000
+	third := batchMessage(3, "billing", "https://a.example.com/hook", "u1", 10)
+	third.CallbackTimeout = 120
+
+	request := batchCallbackRequest([]*models.MessageQueue{&first, &second, &third}, []byte("[]"))
+	if request.UserId != "u1" || request.ServiceName != "billing" {
+		t.Errorf("got user %q service %q, want the ones of the messages", request.UserId, request.ServiceName)
+	}
+	if request.Timeout != 10*time.Second {
+		t.Errorf("got timeout %v, want the shortest one of the chunk", request.Timeout)
+	}
+	if !request.Deadline.Equal(time.Unix(1000, 0)) {
+		t.Errorf("got deadline %v, want the earliest one of the chunk", request.Deadline)
+	}
+
+	// Timeouts are bounded by the server maximum, and a chunk without deadlines has none
+	request = batchCallbackRequest([]*models.MessageQueue{&third}, []byte("[]"))
+	if request.Timeout != 60*time.Second || !request.Deadline.IsZero() {
+		t.Errorf("got timeout %v deadline %v, want the server maximum and no deadline", request.Timeout, request.Deadline)
+	}
+}
+
+func equalIDs(a, b []uint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProcessScheduledBatchDropsExpiredMessages(t *testing.T) {
+	db := migrationstest.Open(t)
+	withAppConfig(t, models.Config{
+		CallbackTimeoutDefault: 5,
+		CallbackTimeoutMax:     30,
+		CallbackBatchMaxItems:  10,
+		CallbackBatchMaxBytes:  1 << 20,
+		DlqMessageLimit:        3,
+		ClaimMode:              models.ClaimSkipLocked,
+		CircuitBreaker:         &models.CircuitBreakerConfig{},
+	})
+	withHTTPDispatchers(t)
+	messageQueueRepository = repositories.NewMessageQueueRepository()
+	thresholdRepository = repositories.NewServiceThresholdRepository()
+
+	requests := make(chan []models.BatchCallbackRequestItem, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var items []models.BatchCallbackRequestItem
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &items); err != nil {
+			t.Errorf("invalid batch %s: %v", body, err)
+		}
+		requests <- items
+	}))
+	defer server.Close()
+
+	now := time.Now().Unix()
+	group := make([]models.MessageQueue, 2)
+	for i, deadline := range []int64{now - 1, now + 60} {
+		group[i] = batchMessage(0, "billing", server.URL+"/callback", "", 2)
+		group[i].Payload = json.RawMessage(`{}`)
+		group[i].Status = models.INPROGRESS
+		group[i].Count = -1
+		group[i].DeliveryDeadline = deadline
+		if err := db.Create(&group[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired, live := group[0].ID, group[1].ID
+
+	processScheduledBatch(db, group)
+
+	select {
+	case items := <-requests:
+		if len(items) != 1 || items[0].ID != live {
+			t.Errorf("batch sent %+v, want only message %d", items, live)
+		}
+	default:
+		t.Fatal("no batch was sent")
+	}
+	for id, want := range map[uint]models.MessageStatusEnums{expired: models.PENDING, live: models.COMPLETED} {
+		var stored models.MessageQueue
+		if err := db.First(&stored, id).Error; err != nil {
+			t.Fatal(err)
+		}
+		if stored.Status != want || stored.IsDLQ != (id == expired) {
+			t.Errorf("message %d is %s with is_dlq %v, want %s", id, stored.Status, stored.IsDLQ, want)
+		}
+	}
+}
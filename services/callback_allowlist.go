@@ -0,0 +1,95 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"schedulerV2/dispatcher"
+	"schedulerV2/models"
+	"strings"
+)
+
+// validateCallbackUrls checks the callback and notification URLs of the message, the notifications are dispatched
+// the same way as callbacks. A token may enqueue for another service, the allowlist of the token service then applies
+// as well so that naming a service without allowlist does not get around it.
+func validateCallbackUrls(message *models.MessageQueue, tokenService string) error {
+	for _, callbackUrl := range []string{message.CallbackUrl, message.OnSuccessUrl, message.OnDeadUrl, message.OnDlqUrl} {
+		if callbackUrl == "" {
+			continue
+		}
+		if !callbackDispatchers.Supports(callbackUrl) {
+			return fmt.Errorf("unsupported callback URL scheme in %s", callbackUrl)
+		}
+		if err := validateCallbackUrl(message.ServiceName, callbackUrl); err != nil {
+			return err
+		}
+		if tokenService != "" && tokenService != message.ServiceName {
+			if err := validateCallbackUrl(tokenService, callbackUrl); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateCallbackUrl checks the callback URL against the allowlist of the service and, for IP literals, against the
+// callback guard. Host names are checked by the guard again at dispatch time once resolved.
+func validateCallbackUrl(serviceName string, callbackUrl string) error {
+	parsed, err := url.Parse(callbackUrl)
+	if err != nil {
+		return fmt.Errorf("invalid callback URL: %v", err)
+	}
+
+	if !callbackUrlAllowed(models.AppConfig.GetServiceConfig(serviceName).AllowedCallbackUrls, parsed) {
+		return fmt.Errorf("callback URL %s is not in the allowlist of service %s", callbackUrl, serviceName)
+	}
+
+	if ip := net.ParseIP(parsed.Hostname()); ip != nil && callbackGuard != nil && !callbackGuard.Allowed(ip) {
+		return fmt.Errorf("callback address %s is not allowed", parsed.Hostname())
+	}
+	return nil
+}
+
+// callbackUrlAllowed reports whether the callback URL matches an allowlist entry, an empty allowlist allows every URL.
+// Entries without a scheme are host patterns, the others are URL prefixes matched on scheme, host and path.
+func callbackUrlAllowed(allowlist []string, callbackUrl *url.URL) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+
+	// Clean the path so that dot segments cannot climb out of an allowed prefix
+	cleanPath := path.Clean("/" + callbackUrl.Path)
+	if strings.HasSuffix(callbackUrl.Path, "/") && cleanPath != "/" {
+		cleanPath += "/"
+	}
+
+	for _, entry := range allowlist {
+		if !strings.Contains(entry, "://") {
+			if dispatcher.MatchHost(entry, callbackUrl.Hostname(), callbackUrl.Port()) {
+				return true
+			}
+			continue
+		}
+
+		pattern, err := url.Parse(entry)
+		if err != nil {
+			lg.Error().Msgf("Ignoring invalid callback allowlist entry %s: %v", entry, err)
+			continue
+		}
+		if strings.EqualFold(pattern.Scheme, callbackUrl.Scheme) && dispatcher.MatchHost(pattern.Host, callbackUrl.Hostname(), callbackUrl.Port()) && pathWithin(cleanPath, pattern.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathWithin reports whether the path is the prefix path or below it, whole segments only, so that /billing does not
+// let through /billing-admin
+func pathWithin(cleanPath string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return cleanPath == prefix || strings.HasPrefix(cleanPath, prefix+"/")
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"net/url"
+	"schedulerV2/models"
+	"testing"
+)
+
+func TestCallbackUrlAllowed(t *testing.T) {
+	allowlist := []string{"*.billing.internal", "api.example.com:8443", "https://hooks.partner.com/billing/", "https://exact.partner.com/hook"}
+
+	tests := []struct {
+		name        string
+		allowlist   []string
+		callbackUrl string
+		want        bool
+	}{
+		{"empty allowlist", nil, "http://anything.example/x", true},
+		{"wildcard subdomain", allowlist, "http://svc.billing.internal/cb", true},
+		{"wildcard excludes apex", allowlist, "http://billing.internal/cb", false},
+		{"host with port", allowlist, "https://api.example.com:8443/cb", true},
+		{"host with other port", allowlist, "https://api.example.com/cb", false},
+		{"prefix itself without slash", allowlist, "https://hooks.partner.com/billing", true},
+		{"prefix itself", allowlist, "https://hooks.partner.com/billing/", true},
+		{"below prefix", allowlist, "https://hooks.partner.com/billing/v2/events", true},
+		{"sibling sharing the prefix", allowlist, "https://hooks.partner.com/billing-admin", false},
+		{"dot segments out of prefix", allowlist, "https://hooks.partner.com/billing/../admin", false},
+		{"prefix with other scheme", allowlist, "http://hooks.partner.com/billing/", false},
+		{"prefix with other host", allowlist, "https://evil.partner.com/billing/", false},
+		{"exact path", allowlist, "https://exact.partner.com/hook", true},
+		{"below exact path", allowlist, "https://exact.partner.com/hook/retry", true},
+		{"exact path extended", allowlist, "https://exact.partner.com/hooks", false},
+		{"host not listed", allowlist, "https://other.example.com/cb", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			callbackUrl, err := url.Parse(test.callbackUrl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := callbackUrlAllowed(test.allowlist, callbackUrl); got != test.want {
+				t.Errorf("callbackUrlAllowed(%s) = %v, want %v", test.callbackUrl, got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateCallbackUrlsWithTokenService(t *testing.T) {
+	withHTTPDispatchers(t)
+	withAppConfig(t, models.Config{Services: map[string]models.ServiceConfig{
+		"billing": {AllowedCallbackUrls: []string{"*.billing.internal"}},
+	}})
+
+	tests := []struct {
+		name         string
+		serviceName  string
+		tokenService string
+		callbackUrl  string
+		wantErr      bool
+	}{
+		{"token service", "billing", "billing", "http://svc.billing.internal/cb", false},
+		{"other service without allowlist", "reports", "billing", "http://svc.billing.internal/cb", false},
+		{"other service outside token allowlist", "reports", "billing", "http://evil.example.com/cb", true},
+		{"token service without allowlist", "billing", "reports", "http://evil.example.com/cb", true},
+		{"no token", "reports", "", "http://evil.example.com/cb", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := &models.MessageQueue{ServiceName: test.serviceName, CallbackUrl: test.callbackUrl}
+			if err := validateCallbackUrls(message, test.tokenService); (err != nil) != test.wantErr {
+				t.Errorf("validateCallbackUrls = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
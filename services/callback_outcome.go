@@ -0,0 +1,66 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"schedulerV2/models"
+	"strconv"
+	"time"
+)
+
+// CallbackStatusError is returned for callback responses whose HTTP status is not 2xx
+type CallbackStatusError struct {
+	StatusCode   int
+	NonRetryable bool
+	// RetryAfter is set when the response carried a Retry-After header honored by the outcome rules
+	RetryAfter time.Time
+}
+
+func (e *CallbackStatusError) Error() string {
+	if e.NonRetryable {
+		return fmt.Sprintf("callback returned non-retryable HTTP status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("callback returned HTTP status %d", e.StatusCode)
+}
+
+// classifyStatus applies the configured outcome rules to a non 2xx callback response
+func classifyStatus(statusCode int, header http.Header, now time.Time) *CallbackStatusError {
+	rules := models.AppConfig.CallbackOutcomes
+	statusErr := &CallbackStatusError{StatusCode: statusCode}
+
+	if rules.NonRetryable4xx && statusCode >= 400 && statusCode < 500 && !containsStatus(rules.Retryable4xxStatuses, statusCode) {
+		statusErr.NonRetryable = true
+		return statusErr
+	}
+
+	if containsStatus(rules.RetryAfterStatuses, statusCode) {
+		statusErr.RetryAfter = parseRetryAfter(header.Get("Retry-After"), now)
+	}
+	return statusErr
+}
+
+// parseRetryAfter parses a Retry-After header given either in delay seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return time.Time{}
+		}
+		return now.Add(time.Duration(seconds) * time.Second)
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at
+	}
+	return time.Time{}
+}
+
+func containsStatus(statuses []int, statusCode int) bool {
+	for _, status := range statuses {
+		if status == statusCode {
+			return true
+		}
+	}
+	return false
+}
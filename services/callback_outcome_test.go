@@ -0,0 +1,86 @@
+package services
+
+import (
+	"net/http"
+	"schedulerV2/models"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  time.Time
+	}{
+		{"empty", "", time.Time{}},
+		{"seconds", "120", testNow.Add(2 * time.Minute)},
+		{"zero seconds", "0", testNow},
+		{"negative seconds", "-5", time.Time{}},
+		{"http date", "Mon, 19 Oct 2026 12:05:00 GMT", testNow.Add(5 * time.Minute)},
+		{"rfc 850 date", "Monday, 19-Oct-26 12:05:00 GMT", testNow.Add(5 * time.Minute)},
+		{"past date", "Mon, 19 Oct 2026 11:00:00 GMT", time.Time{}},
+		{"current date", "Mon, 19 Oct 2026 12:00:00 GMT", time.Time{}},
+		{"garbage", "soon", time.Time{}},
+		{"fractional seconds", "1.5", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value, testNow); !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyStatus(t *testing.T) {
+	defaultRules := &models.CallbackOutcomeConfig{
+		NonRetryable4xx:      true,
+		Retryable4xxStatuses: []int{http.StatusRequestTimeout, http.StatusTooManyRequests},
+		RetryAfterStatuses:   []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+	}
+	retryAll := &models.CallbackOutcomeConfig{RetryAfterStatuses: []int{http.StatusServiceUnavailable}}
+
+	tests := []struct {
+		name             string
+		rules            *models.CallbackOutcomeConfig
+		status           int
+		retryAfter       string
+		wantNonRetryable bool
+		wantRetryAfter   time.Time
+	}{
+		{"400 is non retryable", defaultRules, http.StatusBadRequest, "", true, time.Time{}},
+		{"404 is non retryable", defaultRules, http.StatusNotFound, "", true, time.Time{}},
+		{"408 is retryable", defaultRules, http.StatusRequestTimeout, "", false, time.Time{}},
+		{"429 honors retry after", defaultRules, http.StatusTooManyRequests, "30", false, testNow.Add(30 * time.Second)},
+		{"429 without retry after", defaultRules, http.StatusTooManyRequests, "", false, time.Time{}},
+		{"500 is retryable", defaultRules, http.StatusInternalServerError, "", false, time.Time{}},
+		{"500 ignores retry after", defaultRules, http.StatusInternalServerError, "30", false, time.Time{}},
+		{"503 honors retry after", defaultRules, http.StatusServiceUnavailable, "Mon, 19 Oct 2026 12:01:00 GMT", false, testNow.Add(time.Minute)},
+		{"3xx is retryable", defaultRules, http.StatusFound, "", false, time.Time{}},
+		{"4xx retryable when disabled", retryAll, http.StatusBadRequest, "", false, time.Time{}},
+		{"retry after of an unlisted status", retryAll, http.StatusTooManyRequests, "30", false, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAppConfig(t, models.Config{CallbackOutcomes: tt.rules})
+			header := http.Header{}
+			if tt.retryAfter != "" {
+				header.Set("Retry-After", tt.retryAfter)
+			}
+
+			got := classifyStatus(tt.status, header, testNow)
+			if got.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", got.StatusCode, tt.status)
+			}
+			if got.NonRetryable != tt.wantNonRetryable {
+				t.Errorf("got non retryable %v, want %v", got.NonRetryable, tt.wantNonRetryable)
+			}
+			if !got.RetryAfter.Equal(tt.wantRetryAfter) {
+				t.Errorf("got retry after %v, want %v", got.RetryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
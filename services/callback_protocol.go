@@ -0,0 +1,59 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"schedulerV2/models"
+)
+
+const (
+	// CallbackProtocolHeader advertises the callback response protocol version understood by the scheduler
+	CallbackProtocolHeader = "X-Scheduler-Callback-Protocol"
+
+	// CallbackProtocolV1 only knows SUCCESS, every other status is treated as FAILURE
+	CallbackProtocolV1 = 1
+	// CallbackProtocolV2 adds RETRY_AT, RESCHEDULE, CANCEL and NON_RETRYABLE
+	CallbackProtocolV2 = 2
+
+	CallbackProtocolVersion = CallbackProtocolV2
+)
+
+// normalizeCallbackData validates the callback response against its protocol version.
+// Responses without a version are treated as version 1 so existing callbacks keep working.
+func normalizeCallbackData(data *models.Data) error {
+	if data.Version == 0 {
+		data.Version = CallbackProtocolV1
+	}
+
+	switch data.Version {
+	case CallbackProtocolV1:
+		if data.Status != StatusSuccess {
+			data.Status = StatusFailure
+		}
+		return nil
+	case CallbackProtocolV2:
+	default:
+		return fmt.Errorf("unsupported callback protocol version %d", data.Version)
+	}
+
+	switch data.Status {
+	case StatusSuccess, StatusFailure, StatusCancel, StatusNonRetryable:
+	case StatusRetryAt:
+		if data.RetryAt <= 0 {
+			return fmt.Errorf("callback status %s requires retryAt", data.Status)
+		}
+	case StatusReschedule:
+		if data.NextRetry <= 0 {
+			return fmt.Errorf("callback status %s requires nextRetry", data.Status)
+		}
+		if len(data.Payload) > 0 {
+			var jsonObj map[string]interface{}
+			if err := json.Unmarshal(data.Payload, &jsonObj); err != nil {
+				return fmt.Errorf("callback status %s has an invalid payload: %v", data.Status, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown callback status %q", data.Status)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"encoding/json"
+	"schedulerV2/models"
+	"testing"
+)
+
+func TestNormalizeCallbackData(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        models.Data
+		wantVersion int
+		wantStatus  string
+		wantErr     bool
+	}{
+		{"no version is v1", models.Data{Status: StatusSuccess}, CallbackProtocolV1, StatusSuccess, false},
+		{"v1 success", models.Data{Version: 1, Status: StatusSuccess}, CallbackProtocolV1, StatusSuccess, false},
+		{"v1 failure", models.Data{Version: 1, Status: StatusFailure}, CallbackProtocolV1, StatusFailure, false},
+		{"v1 v2 status is failure", models.Data{Version: 1, Status: StatusCancel}, CallbackProtocolV1, StatusFailure, false},
+		{"v1 unknown status is failure", models.Data{Status: "whatever"}, CallbackProtocolV1, StatusFailure, false},
+		{"v1 empty status is failure", models.Data{}, CallbackProtocolV1, StatusFailure, false},
+		{"v2 success", models.Data{Version: 2, Status: StatusSuccess}, CallbackProtocolV2, StatusSuccess, false},
+		{"v2 failure", models.Data{Version: 2, Status: StatusFailure}, CallbackProtocolV2, StatusFailure, false},
+		{"v2 cancel", models.Data{Version: 2, Status: StatusCancel}, CallbackProtocolV2, StatusCancel, false},
+		{"v2 non retryable", models.Data{Version: 2, Status: StatusNonRetryable}, CallbackProtocolV2, StatusNonRetryable, false},
+		{"v2 retry at", models.Data{Version: 2, Status: StatusRetryAt, RetryAt: 1700000000}, CallbackProtocolV2, StatusRetryAt, false},
+		{"v2 retry at without time", models.Data{Version: 2, Status: StatusRetryAt}, CallbackProtocolV2, StatusRetryAt, true},
+		{"v2 reschedule", models.Data{Version: 2, Status: StatusReschedule, NextRetry: 1700000000}, CallbackProtocolV2, StatusReschedule, false},
+		{"v2 reschedule with payload", models.Data{Version: 2, Status: StatusReschedule, NextRetry: 1700000000, Payload: json.RawMessage(`{"a": 1}`)}, CallbackProtocolV2, StatusReschedule, false},
+		{"v2 reschedule without time", models.Data{Version: 2, Status: StatusReschedule}, CallbackProtocolV2, StatusReschedule, true},
+		{"v2 reschedule with invalid payload", models.Data{Version: 2, Status: StatusReschedule, NextRetry: 1700000000, Payload: json.RawMessage(`[1]`)}, CallbackProtocolV2, StatusReschedule, true},
+		{"v2 unknown status", models.Data{Version: 2, Status: "whatever"}, CallbackProtocolV2, "whatever", true},
+		{"unsupported version", models.Data{Version: 3, Status: StatusSuccess}, 3, StatusSuccess, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.data
+			err := normalizeCallbackData(&data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if data.Version != tt.wantVersion || data.Status != tt.wantStatus {
+				t.Errorf("got version %d status %q, want version %d status %q", data.Version, data.Status, tt.wantVersion, tt.wantStatus)
+			}
+		})
+	}
+}
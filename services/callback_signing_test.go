@@ -0,0 +1,77 @@
+package services
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"schedulerV2/dispatcher"
+	"schedulerV2/models"
+	"schedulerV2/webhook"
+	"testing"
+)
+
+// withHTTPDispatchers routes callbacks through a plain HTTP dispatcher for the test
+func withHTTPDispatchers(t *testing.T) {
+	t.Helper()
+	previous := callbackDispatchers
+	callbackDispatchers = dispatcher.NewRegistry()
+	callbackDispatchers.Register(dispatcher.NewHTTPDispatcher(&models.CallbackTransportConfig{}, nil, nil, nil), "http", "https")
+	t.Cleanup(func() { callbackDispatchers = previous })
+}
+
+func TestSignedCallbackVerifies(t *testing.T) {
+	withAppConfig(t, models.Config{
+		InternalSecretKey:      "internal",
+		InternalTokenApiExpiry: 60000,
+		CallbackTimeoutDefault: 5,
+		CallbackTimeoutMax:     30,
+		Services:               map[string]models.ServiceConfig{"billing": {SigningSecret: "s3cret"}},
+	})
+	withHTTPDispatchers(t)
+
+	type received struct {
+		body      []byte
+		verifyErr error
+		otherErr  error
+	}
+	deliveries := make(chan received, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature, timestamp := r.Header.Get(webhook.SignatureHeader), r.Header.Get(webhook.TimestampHeader)
+		deliveries <- received{
+			body:      body,
+			verifyErr: webhook.Verify([]byte("s3cret"), signature, timestamp, body, 0),
+			otherErr:  webhook.Verify([]byte("other"), signature, timestamp, body, 0),
+		}
+	}))
+	defer server.Close()
+
+	for _, serviceName := range []string{"billing", "reports"} {
+		_, err := dispatchCallback(context.Background(), callbackRequest{
+			Method:      http.MethodPost,
+			Url:         server.URL,
+			ServiceName: serviceName,
+			Body:        []byte(`{"id":42}`),
+		})
+		if err != nil {
+			t.Fatalf("%s callback: %v", serviceName, err)
+		}
+	}
+
+	signed := <-deliveries
+	if signed.verifyErr != nil {
+		t.Errorf("signed callback did not verify: %v", signed.verifyErr)
+	}
+	if string(signed.body) != `{"id":42}` {
+		t.Errorf("got body %s, want the one sent", signed.body)
+	}
+	if signed.otherErr != webhook.ErrInvalidSignature {
+		t.Errorf("verifying with another secret: got %v, want %v", signed.otherErr, webhook.ErrInvalidSignature)
+	}
+
+	// Services without a signing secret send no signature
+	if unsigned := <-deliveries; unsigned.verifyErr != webhook.ErrMissingSignature {
+		t.Errorf("callback of a service without a secret: got %v, want %v", unsigned.verifyErr, webhook.ErrMissingSignature)
+	}
+}
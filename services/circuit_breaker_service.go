@@ -0,0 +1,245 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"schedulerV2/config"
+	"schedulerV2/dispatcher"
+	"schedulerV2/models"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// callbackHost returns the key of the circuit breaker guarding the callback URL
+func callbackHost(callbackUrl string) string {
+	parsed, err := url.Parse(callbackUrl)
+	if err != nil || parsed.Host == "" {
+		return callbackUrl
+	}
+	return parsed.Host
+}
+
+// hostTally counts the callback outcomes of a host since the last flush
+type hostTally struct {
+	successes int64
+	failures  int64
+}
+
+// callbackTallies aggregates callback outcomes in memory, flushCallbackResults adds them to the shared breakers so
+// that every replica writes the row of a host once per flush rather than once per callback
+var callbackTallies = struct {
+	sync.Mutex
+	hosts map[string]*hostTally
+}{hosts: make(map[string]*hostTally)}
+
+// allowCallback reports whether a callback to the host may be sent now. When it may not, deferUntil is the unix time
+// at which messages for the host should be tried again. probe is set for the callback testing a HALF-OPEN breaker,
+// its result decides the next state. Breaker lookups that fail let the callback through.
+func allowCallback(db *gorm.DB, host string) (allowed bool, probe bool, deferUntil int64) {
+	cfg := models.AppConfig.CircuitBreaker
+	if !cfg.Enabled {
+		return true, false, 0
+	}
+
+	breaker, err := circuitBreakerRepository.FindByHost(db, host)
+	if err != nil {
+		if err != gorm.ErrRecordNotFound {
+			lg.Error().Msgf("Error fetching circuit breaker for host %s: %v", host, err)
+		}
+		return true, false, 0
+	}
+
+	if breaker.State == models.CircuitClosed {
+		return true, false, 0
+	}
+
+	now := time.Now().Unix()
+	coolDownEnd := breaker.OpenedAt + int64(cfg.CoolDown)
+	if now < coolDownEnd {
+		return false, false, coolDownEnd
+	}
+
+	// The cool-down is over, a single replica wins the transition and sends the probe.
+	// A HALF-OPEN breaker whose probe never reported back is probed again.
+	won, err := circuitBreakerRepository.Transition(db, breaker, models.CircuitHalfOpen, now)
+	if err != nil {
+		lg.Error().Msgf("Error moving circuit breaker for host %s to HALF-OPEN: %v", host, err)
+		return false, false, now + int64(cfg.CoolDown)
+	}
+	if !won {
+		return false, false, now + int64(cfg.CoolDown)
+	}
+
+	lg.Info().Msgf("Circuit breaker for host %s is HALF-OPEN, sending probe", host)
+	return true, true, 0
+}
+
+// recordCallbackResult feeds the callback outcome into the circuit breaker of the host. The result of a probe closes
+// or reopens the breaker right away, other results are tallied until the next flush.
+func recordCallbackResult(db *gorm.DB, host string, probe bool, callbackErr error) {
+	cfg := models.AppConfig.CircuitBreaker
+	if !cfg.Enabled {
+		return
+	}
+
+	success := !isHostFailure(callbackErr)
+	if probe {
+		recordProbeResult(db, host, success)
+		return
+	}
+
+	callbackTallies.Lock()
+	defer callbackTallies.Unlock()
+	tally, found := callbackTallies.hosts[host]
+	if !found {
+		tally = &hostTally{}
+		callbackTallies.hosts[host] = tally
+	}
+	if success {
+		tally.successes++
+	} else {
+		tally.failures++
+	}
+}
+
+// recordProbeResult closes the HALF-OPEN breaker of the host after a successful probe and reopens it otherwise
+func recordProbeResult(db *gorm.DB, host string, success bool) {
+	breaker, err := circuitBreakerRepository.FindByHost(db, host)
+	if err != nil {
+		lg.Error().Msgf("Error fetching circuit breaker for host %s: %v", host, err)
+		return
+	}
+	if breaker.State != models.CircuitHalfOpen {
+		// The breaker was reset while the probe was sent
+		return
+	}
+
+	to := models.CircuitOpen
+	if success {
+		to = models.CircuitClosed
+	}
+	if won, err := circuitBreakerRepository.Transition(db, breaker, to, time.Now().Unix()); err != nil {
+		lg.Error().Msgf("Error moving circuit breaker for host %s to %s: %v", host, to, err)
+	} else if won {
+		lg.Info().Msgf("Circuit breaker for host %s is %s after probe", host, to)
+	}
+}
+
+// takeCallbackTallies returns the tallies since the last call and starts new ones
+func takeCallbackTallies() map[string]*hostTally {
+	callbackTallies.Lock()
+	defer callbackTallies.Unlock()
+	tallies := callbackTallies.hosts
+	callbackTallies.hosts = make(map[string]*hostTally, len(tallies))
+	return tallies
+}
+
+// flushCallbackResults adds the tallied callback outcomes to the breaker of each host and opens the breakers whose
+// window reached the failure ratio
+func flushCallbackResults() {
+	cfg := models.AppConfig.CircuitBreaker
+	if !cfg.Enabled {
+		return
+	}
+	tallies := takeCallbackTallies()
+	if len(tallies) == 0 {
+		return
+	}
+
+	db, err := config.GetDBConnection()
+	if err != nil {
+		lg.Error().Msgf("Error getting database connection: %v", err)
+		return
+	}
+	recordCallbackTallies(db, tallies, time.Now().Unix())
+}
+
+// recordCallbackTallies adds the tallies to the breakers and opens the ones that should trip
+func recordCallbackTallies(db *gorm.DB, tallies map[string]*hostTally, now int64) {
+	cfg := models.AppConfig.CircuitBreaker
+	for host, tally := range tallies {
+		breaker, err := circuitBreakerRepository.RecordResults(db, host, tally.successes, tally.failures, now, now-int64(cfg.Window))
+		if err != nil {
+			lg.Error().Msgf("Error recording circuit breaker results for host %s: %v", host, err)
+			continue
+		}
+		if breaker.State != models.CircuitClosed || !shouldTrip(breaker, cfg) {
+			continue
+		}
+		if won, err := circuitBreakerRepository.Transition(db, breaker, models.CircuitOpen, now); err != nil {
+			lg.Error().Msgf("Error opening circuit breaker for host %s: %v", host, err)
+		} else if won {
+			lg.Warn().Msgf("Circuit breaker for host %s is OPEN after %d failures out of %d callbacks", host, breaker.Failures, breaker.Successes+breaker.Failures)
+		}
+	}
+}
+
+// shouldTrip reports whether the window of the breaker holds at least MinRequests callbacks and reached the
+// failure ratio
+func shouldTrip(breaker *models.CircuitBreaker, cfg *models.CircuitBreakerConfig) bool {
+	total := breaker.Successes + breaker.Failures
+	if breaker.Failures == 0 || total < int64(cfg.MinRequests) {
+		return false
+	}
+	return float64(breaker.Failures)/float64(total) >= cfg.FailureRatio
+}
+
+// isHostFailure reports whether the callback error means the host is unavailable, as opposed to a rejected message
+func isHostFailure(callbackErr error) bool {
+	if callbackErr == nil || isBlockedAddress(callbackErr) {
+		return false
+	}
+
+	var statusErr *CallbackStatusError
+	if errors.As(callbackErr, &statusErr) {
+		return !statusErr.NonRetryable
+	}
+
+	var urlErr *url.Error
+	return errors.As(callbackErr, &urlErr)
+}
+
+// isBlockedAddress reports whether the callback was refused by the callback guard, which no retry can fix
+func isBlockedAddress(callbackErr error) bool {
+	var blockedErr *dispatcher.BlockedAddressError
+	return errors.As(callbackErr, &blockedErr)
+}
+
+// deferMessage puts a claimed message back to PENDING until deferUntil without consuming a retry
+func deferMessage(db *gorm.DB, message *models.MessageQueue, deferUntil int64) error {
+	lg.Info().Msgf("Deferring message ID %d, circuit breaker for host %s is open", message.ID, callbackHost(message.CallbackUrl))
+	message.Status = models.PENDING
+	message.NextRetry = deferUntil
+	message.LastError = fmt.Sprintf("circuit breaker open for host %s", callbackHost(message.CallbackUrl))
+	if message.MessageType == models.SCHEDULED {
+		return saveScheduledRetry(db, message)
+	}
+	return messageQueueRepository.Save(db, message)
+}
+
+func GetCircuitBreakers() ([]models.CircuitBreaker, error) {
+	db, err := config.GetDBConnection()
+	if err != nil {
+		return nil, fmt.Errorf("error getting database connection: %v", err)
+	}
+	return circuitBreakerRepository.FindAll(db)
+}
+
+func ResetCircuitBreaker(host string) (bool, error) {
+	db, err := config.GetDBConnection()
+	if err != nil {
+		return false, fmt.Errorf("error getting database connection: %v", err)
+	}
+
+	found, err := circuitBreakerRepository.Reset(db, host, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	if found {
+		lg.Info().Msgf("Circuit breaker for host %s reset to CLOSED", host)
+	}
+	return found, nil
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"errors"
+	"net/url"
+	"schedulerV2/migrations/migrationstest"
+	"schedulerV2/models"
+	"schedulerV2/repositories"
+	"testing"
+	"time"
+)
+
+func TestShouldTrip(t *testing.T) {
+	cfg := &models.CircuitBreakerConfig{Enabled: true, FailureRatio: 0.5, MinRequests: 10}
+
+	tests := []struct {
+		name      string
+		successes int64
+		failures  int64
+		want      bool
+	}{
+		{"no callbacks", 0, 0, false},
+		{"below min requests", 0, 9, false},
+		{"min requests reached by successes and failures", 5, 5, true},
+		{"ratio not reached", 6, 4, false},
+		{"ratio exceeded", 2, 18, true},
+		{"only successes", 10, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			breaker := &models.CircuitBreaker{Successes: test.successes, Failures: test.failures}
+			if got := shouldTrip(breaker, cfg); got != test.want {
+				t.Errorf("shouldTrip(%d successes, %d failures) = %v, want %v", test.successes, test.failures, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRecordCallbackResultTallies(t *testing.T) {
+	withAppConfig(t, models.Config{CircuitBreaker: &models.CircuitBreakerConfig{Enabled: true, FailureRatio: 0.5, MinRequests: 1, Window: 60, CoolDown: 60}})
+	takeCallbackTallies()
+
+	hostErr := &url.Error{Op: "Post", URL: "http://a.example", Err: errors.New("connection refused")}
+	recordCallbackResult(nil, "a.example", false, nil)
+	recordCallbackResult(nil, "a.example", false, hostErr)
+	recordCallbackResult(nil, "a.example", false, hostErr)
+	recordCallbackResult(nil, "b.example", false, &CallbackStatusError{NonRetryable: true})
+
+	tallies := takeCallbackTallies()
+	if got := *tallies["a.example"]; got != (hostTally{successes: 1, failures: 2}) {
+		t.Errorf("a.example tally = %+v, want 1 success and 2 failures", got)
+	}
+	if got := *tallies["b.example"]; got != (hostTally{successes: 1}) {
+		t.Errorf("b.example tally = %+v, want a non-retryable status counted as a success", got)
+	}
+	if again := takeCallbackTallies(); len(again) != 0 {
+		t.Errorf("tallies after take = %v, want none", again)
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	db := migrationstest.Open(t)
+	circuitBreakerRepository = repositories.NewCircuitBreakerRepository()
+	cfg := &models.CircuitBreakerConfig{Enabled: true, FailureRatio: 0.5, MinRequests: 4, Window: 60, CoolDown: 3600}
+	withAppConfig(t, models.Config{CircuitBreaker: cfg})
+
+	const host = "breaker.example"
+	hostErr := &url.Error{Op: "Post", URL: "http://" + host, Err: errors.New("connection refused")}
+	state := func() models.CircuitStateEnums {
+		t.Helper()
+		breaker, err := circuitBreakerRepository.FindByHost(db, host)
+		if err != nil {
+			t.Fatalf("FindByHost: %v", err)
+		}
+		return breaker.State
+	}
+
+	// Three failures stay below min_requests
+	recordCallbackTallies(db, map[string]*hostTally{host: {failures: 3}}, time.Now().Unix())
+	if got := state(); got != models.CircuitClosed {
+		t.Fatalf("state below min_requests = %s, want CLOSED", got)
+	}
+
+	// The fourth callback reaches min_requests with a ratio of 1
+	recordCallbackTallies(db, map[string]*hostTally{host: {failures: 1}}, time.Now().Unix())
+	if got := state(); got != models.CircuitOpen {
+		t.Fatalf("state after tripping = %s, want OPEN", got)
+	}
+	if allowed, _, deferUntil := allowCallback(db, host); allowed || deferUntil <= time.Now().Unix() {
+		t.Fatalf("allowCallback during cool-down = %v, %d, want a deferral", allowed, deferUntil)
+	}
+
+	// Once the cool-down is over a single probe is let through
+	cfg.CoolDown = 0
+	allowed, probe, _ := allowCallback(db, host)
+	if !allowed || !probe {
+		t.Fatalf("allowCallback after cool-down = %v, probe %v, want the probe", allowed, probe)
+	}
+	if got := state(); got != models.CircuitHalfOpen {
+		t.Fatalf("state while probing = %s, want HALF-OPEN", got)
+	}
+
+	// A failed probe reopens the breaker, a successful one closes it
+	recordCallbackResult(db, host, true, hostErr)
+	if got := state(); got != models.CircuitOpen {
+		t.Fatalf("state after failed probe = %s, want OPEN", got)
+	}
+	if _, probe, _ := allowCallback(db, host); !probe {
+		t.Fatal("allowCallback after reopening did not send a probe")
+	}
+	recordCallbackResult(db, host, true, nil)
+	if got := state(); got != models.CircuitClosed {
+		t.Fatalf("state after successful probe = %s, want CLOSED", got)
+	}
+
+	// A reset closes an open breaker
+	recordCallbackTallies(db, map[string]*hostTally{host: {failures: 4}}, time.Now().Unix())
+	if got := state(); got != models.CircuitOpen {
+		t.Fatalf("state after tripping again = %s, want OPEN", got)
+	}
+	if _, err := circuitBreakerRepository.Reset(db, host, time.Now().Unix()); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if got := state(); got != models.CircuitClosed {
+		t.Fatalf("state after reset = %s, want CLOSED", got)
+	}
+}
@@ -2,7 +2,10 @@ package services
 
 import (
 	"math"
+	"os"
 	"schedulerV2/config"
+	"schedulerV2/dispatcher"
+	"schedulerV2/locker"
 	"schedulerV2/models"
 	"schedulerV2/repositories"
 	"schedulerV2/zkclient"
@@ -10,30 +13,88 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
 var messageQueueRepository *repositories.MessageQueueRepository
 var thresholdRepository *repositories.ServiceThresholdRepository
+var circuitBreakerRepository *repositories.CircuitBreakerRepository
+var callbackDispatchers *dispatcher.Registry
+var callbackGuard *dispatcher.AddressGuard
 var lg = config.GetLogger(true)
 
+// messageLocker guards the claim of a message in the lock claim mode
+var messageLocker locker.Locker
+
+// replicaID identifies this replica in the claimed_by column of the messages it claims
+var replicaID string
+
+// noRetryLimit is the retry limit of CRON scans, every occurrence counts as a retry
+const noRetryLimit = math.MaxInt32
+
 func InitServices() {
 	messageQueueRepository = repositories.NewMessageQueueRepository()
 	thresholdRepository = repositories.NewServiceThresholdRepository()
+	circuitBreakerRepository = repositories.NewCircuitBreakerRepository()
+	retentionRepository = repositories.NewRetentionRepository()
+	replicaID = newReplicaID()
+	messageLocker = newMessageLocker()
+	callbackGuard = newCallbackGuard()
+	callbackDispatchers = newCallbackDispatchers()
 }
 
 func StartSchedulers() {
 	tickerDLQ := time.NewTicker(2300 * time.Millisecond)
 	tickerProcess := time.NewTicker(1000 * time.Millisecond)
+	tickerReaper := time.NewTicker(30 * time.Second)
+	schedulersStarted.Store(true)
+
+	// The retention and partition channels stay nil, and never fire, while the jobs are disabled
+	var tickerRetention *time.Ticker
+	var retentionTick <-chan time.Time
+	if models.AppConfig.Retention.Enabled {
+		tickerRetention = time.NewTicker(time.Duration(models.AppConfig.Retention.Interval) * time.Second)
+		retentionTick = tickerRetention.C
+	}
+	var tickerPartitions *time.Ticker
+	var partitionTick <-chan time.Time
+	if models.AppConfig.Partitioning.Enabled {
+		tickerPartitions = time.NewTicker(time.Duration(models.AppConfig.Partitioning.Interval) * time.Second)
+		partitionTick = tickerPartitions.C
+		// Partitions missed while no replica was running are created right away rather than after an interval
+		runJob(maintainPartitions)
+	}
 
 	go func() {
+		defer close(schedulersDone)
+		defer tickerDLQ.Stop()
+		defer tickerProcess.Stop()
+		defer tickerReaper.Stop()
+		if tickerRetention != nil {
+			defer tickerRetention.Stop()
+		}
+		if tickerPartitions != nil {
+			defer tickerPartitions.Stop()
+		}
+
 		for {
 			select {
 			case <-tickerDLQ.C:
-				go updateScheduledDLQMessageStatus()
+				runJob(updateScheduledDLQMessageStatus)
 			case <-tickerProcess.C:
-				go scanAndProcessScheduledMessages()
-				go scanAndProcessCronMessages()
+				runJob(scanAndProcessScheduledMessages)
+				runJob(scanAndProcessCronMessages)
+				runJob(sendTerminalNotifications)
+				runJob(flushCallbackResults)
+			case <-tickerReaper.C:
+				runJob(reapExpiredLeases)
+			case <-retentionTick:
+				runJob(applyRetention)
+			case <-partitionTick:
+				runJob(maintainPartitions)
+			case <-stopSchedulers:
+				return
 			}
 		}
 	}()
@@ -56,53 +117,27 @@ func updateScheduledDLQMessageStatus() {
 
 	for _, message := range messages {
 
-		// Acquire the lock with a distinct DLQ identifier before starting the transaction
-		lockName := zkclient.LockName + "DLQ" + strconv.Itoa(int(message.ID))
-		lock := zkclient.NewDistributedLock(config.ZkConn, zkclient.LockBasePath, lockName)
-		acquired, err := lock.Acquire()
-		if err != nil {
-			lg.Error().Msgf("Error acquiring DLQ lock for message ID %d: %v", message.ID, err)
-			continue
-		}
-		if !acquired {
-			// DLQ Lock not acquired, skip this message
-			continue
-		}
-
-		// Ensure the lock is released after the transaction is done
-		defer func() {
-			if err := lock.Release(); err != nil {
-				lg.Error().Msgf("Error releasing DLQ lock for message ID %d: %v", message.ID, err)
+		// In skip_locked claim mode the move itself only succeeds for one replica
+		if models.AppConfig.ClaimMode != models.ClaimSkipLocked {
+			// Acquire the lock with a distinct DLQ identifier before starting the transaction
+			release, acquired, err := acquireLock(zkclient.LockName + "DLQ" + strconv.Itoa(int(message.ID)))
+			if err != nil {
+				lg.Error().Msgf("Error acquiring DLQ lock for message ID %d: %v", message.ID, err)
+				continue
+			}
+			if !acquired {
+				// DLQ Lock not acquired, skip this message
+				continue
 			}
-		}()
-
-		// Start a transaction
-		tx := db.Begin()
-		if tx.Error != nil {
-			lg.Error().Msgf("Error starting transaction: %v", tx.Error)
-			continue
-		}
-
-		dlqMessage := models.DlqMessageQueue{MessageID: message.ID, IsProcessed: false}
-		message.IsDLQ = true
 
-		// Save DLQ message within the transaction
-		if err := tx.Create(&dlqMessage).Error; err != nil {
-			tx.Rollback()
-			lg.Error().Msgf("Error - %v saving DLQ message: %v", err, message)
-			continue
+			// Ensure the lock is released after the transaction is done
+			defer release()
 		}
 
-		// Save message status within the transaction
-		if err := tx.Save(&message).Error; err != nil {
-			tx.Rollback()
-			lg.Error().Msgf("Error - %v updating message status: %v", err, message)
+		if err := moveToDLQ(db, &message); err == repositories.ErrAlreadyInDLQ {
 			continue
-		}
-
-		// Commit the transaction
-		if err := tx.Commit().Error; err != nil {
-			lg.Error().Msgf("Transaction commit failed: %v", err)
+		} else if err != nil {
+			lg.Error().Msgf("Error - %v moving message to DLQ: %v", err, message)
 			continue
 		}
 
@@ -118,60 +153,30 @@ func scanAndProcessScheduledMessages() {
 		lg.Error().Msgf("Error getting database connection: %v", err)
 		return
 	}
-	nowPlusOneSecond := time.Now().Unix() + 1
-	messages, err := messageQueueRepository.FindByStatusAndNextRetryAndRetryCountAndIsDLQ(db, string(models.PENDING), string(models.SCHEDULED), false, models.AppConfig.DlqMessageLimit, nowPlusOneSecond)
+	messages, err := fetchDueMessages(db, models.SCHEDULED, models.AppConfig.DlqMessageLimit)
 	if err != nil {
 		lg.Error().Msgf("Error fetching messages: %v", err)
 		return
 	}
 	var wg sync.WaitGroup
+	var batched []models.MessageQueue
 
 	for _, message := range messages {
+		if message.BatchCallback {
+			batched = append(batched, message)
+			continue
+		}
+
 		wg.Add(1)
 		go func(msg models.MessageQueue) {
 			// Decrement the counter when the go routine completes
 			defer wg.Done()
 
-			currentTime := time.Now().Unix()
-			threshold, err := thresholdRepository.FindByServiceName(db, msg.ServiceName, currentTime)
-			if err != nil || (threshold != nil && !thresholdRepository.IsWithinThreshold(threshold)) {
-				msg.Status = models.DEAD
-				if saveErr := messageQueueRepository.Save(db, &msg); saveErr != nil {
-					lg.Error().Msgf("Failed to mark message ID %d as DEAD: %v", msg.ID, saveErr)
-				}
-
-				if err != nil && err != gorm.ErrRecordNotFound {
-					lg.Error().Msgf("Error checking service threshold for message ID %d: %v", msg.ID, err)
-				} else {
-					lg.Info().Msgf("Message ID %d marked as DEAD - outside service threshold", msg.ID)
-				}
-				return
-			}
-
-			lock := zkclient.NewDistributedLock(config.ZkConn, zkclient.LockBasePath, zkclient.LockName+strconv.Itoa(int(msg.ID)))
-			acquired, err := lock.Acquire()
-			if err != nil {
-				lg.Error().Msgf("Error acquiring lock for message ID %d: %v", msg.ID, err)
-				return
-			}
-			if !acquired {
-				// Lock not acquired, another process is already processing this message
-				return
-			}
-
-			if msg.RetryCount >= models.AppConfig.DlqMessageLimit {
-				msg.Status = models.COMPLETED
-				messageQueueRepository.Save(db, &msg)
-				return
-			}
-
-			defer lock.Release()
-
-			// Update the message status to IN_PROGRESS in the database
-			if err := setMessageStatusInProgress(db, &msg); err != nil {
-				lg.Error().Msgf("Failed to set IN-PROGRESS status for message ID %d: %v", msg.ID, err)
+			release, claimed := claimScheduledMessage(db, &msg)
+			if !claimed {
 				return
 			}
+			defer release()
 
 			// Proceed with processing the message
 			if err := processScheduledMessage(db, &msg); err != nil {
@@ -181,9 +186,134 @@ func scanAndProcessScheduledMessages() {
 			}
 		}(message)
 	}
+
+	for _, group := range groupByCallbackEndpoint(batched) {
+		wg.Add(1)
+		go func(group []models.MessageQueue) {
+			defer wg.Done()
+			processScheduledBatch(db, group)
+		}(group)
+	}
 	wg.Wait()
 }
 
+// newReplicaID returns the host name with a random suffix, so restarted or co-located replicas are told apart
+func newReplicaID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "scheduler"
+	}
+	return hostname + "-" + uuid.NewString()[:8]
+}
+
+// fetchDueMessages returns the due PENDING messages of the type. In skip_locked claim mode they are returned already
+// claimed IN-PROGRESS by this replica.
+func fetchDueMessages(db *gorm.DB, messageType models.MessageTypeEnums, retryLimit int) ([]models.MessageQueue, error) {
+	if draining.Load() {
+		return nil, nil
+	}
+
+	now := time.Now().Unix()
+	if models.AppConfig.ClaimMode == models.ClaimSkipLocked {
+		// Only messages due now are claimed, claimed messages are not put back to wait for their time
+		leaseUntil := now + int64(models.AppConfig.ClaimLease)
+		return messageQueueRepository.ClaimDue(db, messageType, retryLimit, now, models.AppConfig.MessagesLimit, replicaID, leaseUntil)
+	}
+	nowPlusOneSecond := now + 1
+	return messageQueueRepository.FindByStatusAndNextRetryAndRetryCountAndIsDLQ(db, string(models.PENDING), string(messageType), false, retryLimit, nowPlusOneSecond)
+}
+
+// claimScheduledMessage checks the service threshold, acquires the message lock and marks the message IN-PROGRESS.
+// release must be called once the message is processed, and only when it was claimed. Messages fetched in
+// skip_locked claim mode are already claimed and need no lock.
+func claimScheduledMessage(db *gorm.DB, msg *models.MessageQueue) (release func(), claimed bool) {
+	currentTime := time.Now().Unix()
+	threshold, err := thresholdRepository.FindByServiceName(db, msg.ServiceName, currentTime)
+	if err != nil || (threshold != nil && !thresholdRepository.IsWithinThreshold(threshold)) {
+		msg.Status = models.DEAD
+		queueTerminalNotification(msg, models.NotifyDead)
+		if saveErr := messageQueueRepository.Save(db, msg); saveErr != nil {
+			lg.Error().Msgf("Failed to mark message ID %d as DEAD: %v", msg.ID, saveErr)
+		}
+
+		if err != nil && err != gorm.ErrRecordNotFound {
+			lg.Error().Msgf("Error checking service threshold for message ID %d: %v", msg.ID, err)
+		} else {
+			lg.Info().Msgf("Message ID %d marked as DEAD - outside service threshold", msg.ID)
+		}
+		return nil, false
+	}
+
+	if models.AppConfig.ClaimMode == models.ClaimSkipLocked {
+		return func() {}, true
+	}
+
+	// A replica shutting down finishes the messages it claimed and leaves the others to the remaining replicas
+	if draining.Load() {
+		return nil, false
+	}
+
+	release, acquired, err := acquireLock(zkclient.LockName + strconv.Itoa(int(msg.ID)))
+	if err != nil {
+		lg.Error().Msgf("Error acquiring lock for message ID %d: %v", msg.ID, err)
+		return nil, false
+	}
+	if !acquired {
+		// Lock not acquired, another process is already processing this message
+		return nil, false
+	}
+
+	if msg.RetryCount >= models.AppConfig.DlqMessageLimit {
+		msg.Status = models.COMPLETED
+		messageQueueRepository.Save(db, msg)
+		release()
+		return nil, false
+	}
+
+	// Update the message status to IN_PROGRESS in the database
+	if err := setMessageStatusInProgress(db, msg); err != nil {
+		lg.Error().Msgf("Failed to set IN-PROGRESS status for message ID %d: %v", msg.ID, err)
+		release()
+		return nil, false
+	}
+
+	return release, true
+}
+
+// claimCronMessage acquires the message lock and marks the cron message IN-PROGRESS, unless it was already claimed
+// in skip_locked claim mode
+func claimCronMessage(db *gorm.DB, msg *models.MessageQueue) (release func(), claimed bool) {
+	if models.AppConfig.ClaimMode == models.ClaimSkipLocked {
+		return func() {}, true
+	}
+
+	// A replica shutting down finishes the messages it claimed and leaves the others to the remaining replicas
+	if draining.Load() {
+		return nil, false
+	}
+
+	// Acquire distributed lock
+	release, acquired, err := acquireLock(zkclient.LockName + strconv.Itoa(int(msg.ID)))
+	if err != nil {
+		lg.Error().Msgf("Error acquiring lock for message ID %d: %v", msg.ID, err)
+		return nil, false
+	}
+
+	if !acquired {
+		// Lock not acquired, another process is already processing this message
+		return nil, false
+	}
+
+	// Update the message status to IN_PROGRESS in the database
+	if err := setMessageStatusInProgress(db, msg); err != nil {
+		lg.Error().Msgf("Failed to set IN-PROGRESS status for message ID %d: %v", msg.ID, err)
+		release()
+		return nil, false
+	}
+
+	return release, true
+}
+
 func scanAndProcessCronMessages() {
 	lg.Info().Msg("Scanning & Processing cron messages...")
 
@@ -193,8 +323,7 @@ func scanAndProcessCronMessages() {
 		return
 	}
 	// Fetch cron messages
-	nowPlusOneSecond := time.Now().Unix() + 1
-	cronMessages, err := messageQueueRepository.FindByStatusAndNextRetryAndRetryCountAndIsDLQ(db, string(models.PENDING), string(models.CRON), false, int(math.Inf(1)), nowPlusOneSecond)
+	cronMessages, err := fetchDueMessages(db, models.CRON, noRetryLimit)
 	if err != nil {
 		lg.Error().Msgf("Error fetching cron messages: %v", err)
 		return
@@ -208,6 +337,7 @@ func scanAndProcessCronMessages() {
 
 			if msg.Count != -1 && msg.Count < msg.RetryCount {
 				msg.Status = models.COMPLETED
+				queueTerminalNotification(&msg, models.NotifyCompleted)
 				messageQueueRepository.Save(db, &msg)
 				return
 			}
@@ -215,28 +345,18 @@ func scanAndProcessCronMessages() {
 			// Calculate the next run time from the next retry time
 			nextRetryTime := time.Unix(msg.NextRetry, 0).UTC()
 			if time.Now().UTC().Before(nextRetryTime) {
+				if msg.Status == models.INPROGRESS {
+					msg.Status = models.PENDING
+					messageQueueRepository.Save(db, &msg)
+				}
 				return
 			}
 
-			// Acquire distributed lock
-			lock := zkclient.NewDistributedLock(config.ZkConn, zkclient.LockBasePath, zkclient.LockName+strconv.Itoa(int(msg.ID)))
-			acquired, err := lock.Acquire()
-			if err != nil {
-				lg.Error().Msgf("Error acquiring lock for message ID %d: %v", msg.ID, err)
-				return
-			}
-
-			if !acquired {
-				// Lock not acquired, another process is already processing this message
-				return
-			}
-			defer lock.Release()
-
-			// Update the message status to IN_PROGRESS in the database
-			if err := setMessageStatusInProgress(db, &msg); err != nil {
-				lg.Error().Msgf("Failed to set IN-PROGRESS status for message ID %d: %v", msg.ID, err)
+			release, claimed := claimCronMessage(db, &msg)
+			if !claimed {
 				return
 			}
+			defer release()
 
 			// Time to process the message
 			lg.Info().Msgf("Processing message ID %d", msg.ID)
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"schedulerV2/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MessageIdHeader   = "X-Scheduler-Message-Id"
+	AttemptHeader     = "X-Scheduler-Attempt"
+	ScheduledAtHeader = "X-Scheduler-Scheduled-At"
+	MessageTypeHeader = "X-Scheduler-Message-Type"
+)
+
+// deliveryContext describes a single delivery of a message. It is sent as metadata headers and substituted into
+// payloads enqueued with payloadTemplate.
+type deliveryContext struct {
+	MessageId   uint
+	MessageType models.MessageTypeEnums
+	// Attempt counts the attempts of a SCHEDULED message, a CRON occurrence is always attempted once
+	Attempt int
+	// Occurrence is the index of the CRON occurrence, always 1 for SCHEDULED messages
+	Occurrence int
+	// ScheduledAt is the time the message was originally scheduled for, or the time of the CRON occurrence
+	ScheduledAt int64
+	FireTime    int64
+}
+
+func newDeliveryContext(message *models.MessageQueue) deliveryContext {
+	delivery := deliveryContext{
+		MessageId:   message.ID,
+		MessageType: message.MessageType,
+		Attempt:     message.RetryCount + 1,
+		Occurrence:  1,
+		ScheduledAt: message.ScheduledAt,
+		FireTime:    time.Now().Unix(),
+	}
+
+	if message.MessageType == models.CRON {
+		delivery.Attempt = 1
+		delivery.Occurrence = message.RetryCount + 1
+		delivery.ScheduledAt = message.NextRetry
+	}
+
+	// Messages enqueued before scheduled_at existed fall back to their next run
+	if delivery.ScheduledAt == 0 {
+		delivery.ScheduledAt = message.NextRetry
+	}
+	return delivery
+}
+
+func (d deliveryContext) setHeaders(header http.Header) {
+	header.Set(MessageIdHeader, strconv.FormatUint(uint64(d.MessageId), 10))
+	header.Set(AttemptHeader, strconv.Itoa(d.Attempt))
+	header.Set(ScheduledAtHeader, strconv.FormatInt(d.ScheduledAt, 10))
+	header.Set(MessageTypeHeader, string(d.MessageType))
+}
+
+func (d deliveryContext) templateValues() map[string]int64 {
+	return map[string]int64{
+		"messageId":   int64(d.MessageId),
+		"attempt":     int64(d.Attempt),
+		"occurrence":  int64(d.Occurrence),
+		"scheduledAt": d.ScheduledAt,
+		"fireTime":    d.FireTime,
+	}
+}
+
+// deliveryPayload returns the payload of the message, rendered for the delivery when it is a template
+func deliveryPayload(message *models.MessageQueue, d deliveryContext) (json.RawMessage, error) {
+	if !message.PayloadTemplate {
+		return message.Payload, nil
+	}
+	payload, err := renderPayload(message.Payload, d)
+	if err != nil {
+		return nil, fmt.Errorf("error rendering payload template: %v", err)
+	}
+	return payload, nil
+}
+
+// renderPayload substitutes {{attempt}}, {{occurrence}}, {{scheduledAt}}, {{fireTime}} and {{messageId}} in the string
+// values of the payload. A string that is exactly one placeholder becomes a number, placeholders inside longer strings
+// are replaced by their text. Unknown placeholders are left as they are.
+func renderPayload(payload json.RawMessage, d deliveryContext) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	value = renderValue(value, d.templateValues())
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+func renderValue(value interface{}, values map[string]int64) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = renderValue(item, values)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = renderValue(item, values)
+		}
+		return v
+	case string:
+		if !strings.Contains(v, "{{") {
+			return v
+		}
+		for name, replacement := range values {
+			placeholder := "{{" + name + "}}"
+			if v == placeholder {
+				return replacement
+			}
+			v = strings.ReplaceAll(v, placeholder, strconv.FormatInt(replacement, 10))
+		}
+		return v
+	default:
+		return v
+	}
+}
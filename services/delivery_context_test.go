@@ -0,0 +1,46 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRenderPayload(t *testing.T) {
+	delivery := deliveryContext{MessageId: 42, Attempt: 3, Occurrence: 1, ScheduledAt: 1790000000, FireTime: 1790000005}
+
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{"exact placeholder becomes a number", `{"n":"{{attempt}}"}`, `{"n":3}`},
+		{"every placeholder", `{"a":"{{attempt}}","f":"{{fireTime}}","id":"{{messageId}}","o":"{{occurrence}}","s":"{{scheduledAt}}"}`, `{"a":3,"f":1790000005,"id":42,"o":1,"s":1790000000}`},
+		{"placeholder inside text stays a string", `{"n":"try {{attempt}}"}`, `{"n":"try 3"}`},
+		{"several placeholders in one string", `{"n":"{{messageId}}-{{attempt}}"}`, `{"n":"42-3"}`},
+		{"padded placeholder stays a string", `{"n":" {{attempt}}"}`, `{"n":" 3"}`},
+		{"unknown placeholder left as is", `{"n":"{{retries}}"}`, `{"n":"{{retries}}"}`},
+		{"nested objects and arrays", `{"a":[{"b":"{{attempt}}"},"{{messageId}}"]}`, `{"a":[{"b":3},42]}`},
+		{"top level string", `"{{scheduledAt}}"`, `1790000000`},
+		{"keys are not rendered", `{"{{attempt}}":1}`, `{"{{attempt}}":1}`},
+		{"large numbers keep their precision", `{"n":12345678901234567890,"f":1.50}`, `{"f":1.50,"n":12345678901234567890}`},
+		{"HTML is not escaped", `{"n":"<b>{{attempt}}</b>&"}`, `{"n":"<b>3</b>&"}`},
+		{"no placeholders", `{"n":true,"m":null}`, `{"m":null,"n":true}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := renderPayload(json.RawMessage(test.payload), delivery)
+			if err != nil {
+				t.Fatalf("renderPayload: %v", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("renderPayload(%s) = %s, want %s", test.payload, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRenderPayloadRejectsInvalidJSON(t *testing.T) {
+	if _, err := renderPayload(json.RawMessage(`{"n":`), deliveryContext{}); err == nil {
+		t.Error("renderPayload accepted invalid JSON")
+	}
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"schedulerV2/dispatcher"
+	"schedulerV2/models"
+
+	"github.com/nats-io/nats.go"
+)
+
+// newCallbackGuard returns the address guard of the http and grpc dispatchers, nil when it is disabled
+func newCallbackGuard() *dispatcher.AddressGuard {
+	cfg := models.AppConfig.CallbackGuard
+	if !cfg.Enabled {
+		return nil
+	}
+
+	guard, err := dispatcher.NewAddressGuard(cfg.AllowedCIDRs)
+	if err != nil {
+		lg.Fatal().Err(err).Msg("Failed to configure the callback guard")
+	}
+	return guard
+}
+
+// newCallbackDispatchers registers the HTTP and gRPC dispatchers and the event bus sinks enabled in the config
+func newCallbackDispatchers() *dispatcher.Registry {
+	profiles, err := dispatcher.LoadTLSProfiles(models.AppConfig.TLSProfiles)
+	if err != nil {
+		lg.Fatal().Err(err).Msg("Failed to load TLS profiles")
+	}
+
+	var proxies *dispatcher.ProxyRules
+	if models.AppConfig.CallbackProxy != nil {
+		proxies, err = dispatcher.NewProxyRules(models.AppConfig.CallbackProxy)
+		if err != nil {
+			lg.Fatal().Err(err).Msg("Failed to load the callback proxy rules")
+		}
+	}
+
+	registry := dispatcher.NewRegistry()
+	registry.Register(dispatcher.NewHTTPDispatcher(models.AppConfig.CallbackTransport, profiles, callbackGuard, proxies), "http", "https")
+	registry.Register(dispatcher.NewGRPCDispatcher(models.AppConfig.GrpcTargets, profiles, callbackGuard), "grpc")
+
+	bus := models.AppConfig.EventBus
+	if bus == nil {
+		return registry
+	}
+
+	if bus.InMemory {
+		broker := dispatcher.NewMemoryBroker()
+		registry.Register(dispatcher.NewNATSDispatcher(broker), "nats")
+		registry.Register(dispatcher.NewKafkaDispatcher(broker), "kafka")
+		lg.Info().Msg("Using the in-memory broker for nats and kafka callbacks")
+		return registry
+	}
+
+	if bus.NatsUrl != "" {
+		conn, err := nats.Connect(bus.NatsUrl, nats.Name(models.AppConfig.ServiceName), nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+		if err != nil {
+			lg.Error().Msgf("Error connecting to nats at %s, nats callbacks are disabled: %v", bus.NatsUrl, err)
+		} else {
+			registry.Register(dispatcher.NewNATSDispatcher(conn), "nats")
+		}
+	}
+
+	if len(bus.KafkaBrokers) > 0 {
+		registry.Register(dispatcher.NewKafkaDispatcher(dispatcher.NewKafkaWriter(bus.KafkaBrokers)), "kafka")
+	}
+	return registry
+}
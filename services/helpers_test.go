@@ -0,0 +1,14 @@
+package services
+
+import (
+	"schedulerV2/models"
+	"testing"
+)
+
+// withAppConfig replaces the application config for the test, restoring it when the test ends
+func withAppConfig(t *testing.T, config models.Config) {
+	t.Helper()
+	previous := models.AppConfig
+	models.AppConfig = config
+	t.Cleanup(func() { models.AppConfig = previous })
+}
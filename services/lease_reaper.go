@@ -0,0 +1,103 @@
+package services
+
+import (
+	"expvar"
+	"fmt"
+	"schedulerV2/config"
+	"schedulerV2/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Counters of the lease reaper, published with expvar under "message_reaper"
+var (
+	reaperMetrics = expvar.NewMap("message_reaper")
+
+	reapedPending = new(expvar.Int)
+	reapedDLQ     = new(expvar.Int)
+	reapErrors    = new(expvar.Int)
+)
+
+func init() {
+	reaperMetrics.Set("reaped_pending", reapedPending)
+	reaperMetrics.Set("reaped_dlq", reapedDLQ)
+	reaperMetrics.Set("errors", reapErrors)
+}
+
+// reapExpiredLeases returns IN-PROGRESS messages whose replica stopped renewing their lease, after a crash or a lost
+// database connection, to PENDING. Every replica runs it, a message is only reaped by the first one.
+func reapExpiredLeases() {
+	db, err := config.GetDBConnection()
+	if err != nil {
+		lg.Error().Msgf("Error getting database connection: %v", err)
+		return
+	}
+
+	now := time.Now()
+	staleBefore := now.Add(-time.Duration(models.AppConfig.ClaimLease) * time.Second)
+	messages, err := messageQueueRepository.FindExpiredLeases(db, now.Unix(), staleBefore, models.AppConfig.MessagesLimit)
+	if err != nil {
+		lg.Error().Msgf("Error fetching messages with expired leases: %v", err)
+		return
+	}
+
+	for i := range messages {
+		if err := reapMessage(db, &messages[i]); err != nil {
+			reapErrors.Add(1)
+			lg.Error().Msgf("Error reaping message ID %d: %v", messages[i].ID, err)
+		}
+	}
+}
+
+// reapMessage releases the expired lease of the message and, once it was orphaned MaxOrphanings times, moves it to
+// the DLQ in the same transaction so no replica claims it in between
+func reapMessage(db *gorm.DB, message *models.MessageQueue) error {
+	claimedBy := message.ClaimedBy
+	if claimedBy == "" {
+		claimedBy = "an unknown replica"
+	}
+	message.LastError = fmt.Sprintf("lease of %s expired while the message was IN-PROGRESS", claimedBy)
+
+	var reaped, dlq bool
+	err := db.Transaction(func(tx *gorm.DB) error {
+		released, err := messageQueueRepository.ReleaseExpiredLease(tx, message)
+		if err != nil || !released {
+			return err
+		}
+		reaped = true
+
+		if message.Status == models.PENDING && message.OrphanCount >= models.AppConfig.MaxOrphanings {
+			dlq = true
+			return moveToDLQ(tx, message)
+		}
+		return nil
+	})
+	if err != nil || !reaped {
+		return err
+	}
+
+	if dlq {
+		reapedDLQ.Add(1)
+		lg.Info().Msgf("Moved message ID %d to the DLQ after %d expired leases", message.ID, message.OrphanCount)
+	} else if message.Status == models.CANCELLED {
+		lg.Info().Msgf("Cancelled message ID %d after its lease expired, %s", message.ID, message.LastError)
+	} else {
+		reapedPending.Add(1)
+		lg.Info().Msgf("Returned message ID %d to PENDING, %s", message.ID, message.LastError)
+	}
+	return nil
+}
+
+// extendLeases renews the leases of claimed messages that are processed one after another, such as the chunks of a
+// batch, so the lease of the last chunk does not run out while the earlier ones are sent
+func extendLeases(db *gorm.DB, messages []*models.MessageQueue) {
+	leaseUntil := time.Now().Unix() + int64(models.AppConfig.ClaimLease)
+	if err := messageQueueRepository.ExtendLease(db, messages, replicaID, leaseUntil); err != nil {
+		lg.Error().Msgf("Error extending the leases of %d messages: %v", len(messages), err)
+		return
+	}
+	for _, msg := range messages {
+		msg.LeaseUntil = leaseUntil
+	}
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"schedulerV2/config"
+	"schedulerV2/locker"
+	"schedulerV2/models"
+	"schedulerV2/zkclient"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// newMessageLocker returns the locker of the configured lock_backend
+func newMessageLocker() locker.Locker {
+	switch models.AppConfig.LockBackend {
+	case models.LockPostgres:
+		return locker.NewPostgresLocker(func() (*sql.DB, error) {
+			db, err := config.GetDBConnection()
+			if err != nil {
+				return nil, err
+			}
+			return db.DB()
+		}, models.AppConfig.LockSessions)
+	case models.LockMemory:
+		lg.Warn().Msg("Using the in-memory locker, message locks are not shared with other replicas")
+		return locker.NewMemoryLocker()
+	default:
+		return locker.NewZooKeeperLocker(func() *zk.Conn { return config.ZkConn }, zkclient.LockBasePath)
+	}
+}
+
+// acquireLock takes the named lock, release must be called once the work it guards is done, and only when acquired
+func acquireLock(name string) (release func(), acquired bool, err error) {
+	ctx := context.Background()
+	acquired, err = messageLocker.TryAcquire(ctx, name)
+	if err != nil || !acquired {
+		return nil, false, err
+	}
+
+	return func() {
+		if err := messageLocker.Release(ctx, name); err != nil {
+			lg.Error().Msgf("Error releasing lock %s: %v", name, err)
+		}
+	}, true, nil
+}
@@ -4,13 +4,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"schedulerV2/config"
+	"schedulerV2/dispatcher"
 	"schedulerV2/middleware"
 	"schedulerV2/models"
+	"schedulerV2/repositories"
+	"schedulerV2/webhook"
+	"strconv"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 	"gorm.io/gorm"
 )
 
@@ -18,9 +27,35 @@ const (
 	ContentTypeApplicationJSON = "application/json"
 	StatusSuccess              = "SUCCESS"
 	StatusFailure              = "FAILURE"
+	StatusRetryAt              = "RETRY_AT"
+	StatusReschedule           = "RESCHEDULE"
+	StatusCancel               = "CANCEL"
+	StatusNonRetryable         = "NON_RETRYABLE"
 )
 
 func processScheduledMessage(db *gorm.DB, message *models.MessageQueue) error {
+	// Messages picked up after their delivery deadline are not sent at all
+	if deliveryDeadlinePassed(message, time.Now().Unix()) {
+		return moveToDLQAfterDeadline(db, message)
+	}
+
+	host := callbackHost(message.CallbackUrl)
+	allowed, probe, deferUntil := allowCallback(db, host)
+	if !allowed {
+		return deferMessage(db, message, deferUntil)
+	}
+
+	callbackResponse, err := sendCallback(message)
+	recordCallbackResult(db, host, probe, err)
+	if err != nil {
+		return applyScheduledCallbackResult(db, message, nil, err)
+	}
+	storeCallbackResult(message, callbackResponse.Raw)
+	return applyScheduledCallbackResult(db, message, &callbackResponse.Data, nil)
+}
+
+// applyScheduledCallbackResult completes, retries, reschedules, cancels or dead-letters the message based on the callback outcome
+func applyScheduledCallbackResult(db *gorm.DB, message *models.MessageQueue, data *models.Data, callbackErr error) error {
 	currentTime := time.Now().Unix()
 
 	// Find and update threshold count
@@ -29,86 +64,370 @@ func processScheduledMessage(db *gorm.DB, message *models.MessageQueue) error {
 		return fmt.Errorf("error finding service threshold: %v", err)
 	}
 
-	callbackResponse, err := sendCallback(message)
+	if callbackErr == nil {
+		callbackErr = normalizeCallbackData(data)
+	}
+
 	message.Status = models.PENDING
-	if err != nil {
-		lg.Error().Msgf("Error sending callback: %v", err)
+	if callbackErr != nil {
+		lg.Error().Msgf("Error sending callback: %v", callbackErr)
+		message.LastError = callbackErr.Error()
+
+		var statusErr *CallbackStatusError
+		if (errors.As(callbackErr, &statusErr) && statusErr.NonRetryable) || isBlockedAddress(callbackErr) {
+			return moveToDLQ(db, message)
+		}
+
 		handleRetry(message)
-	} else if callbackResponse.Data.Status == StatusSuccess {
+		if statusErr != nil && statusErr.RetryAfter.Unix() > message.NextRetry {
+			message.NextRetry = statusErr.RetryAfter.Unix()
+		}
+		return saveScheduledRetry(db, message)
+	}
+
+	switch data.Status {
+	case StatusSuccess:
 		message.Status = models.COMPLETED
+		queueTerminalNotification(message, models.NotifyCompleted)
+		message.LastError = ""
 		// Increment threshold count on successful processing
 		if threshold != nil {
 			if err := thresholdRepository.IncrementCount(db, threshold); err != nil {
 				lg.Error().Msgf("Error incrementing threshold count: %v", err)
 			}
 		}
-	} else {
+	case StatusRetryAt:
+		message.RetryCount++
+		message.NextRetry = data.RetryAt
+	case StatusReschedule:
+		rescheduleMessage(message, data)
+	case StatusCancel:
+		message.Status = models.CANCELLED
+	case StatusNonRetryable:
+		lg.Info().Msgf("Message ID %d is non-retryable: %s", message.ID, data.Reason)
+		message.LastError = nonRetryableReason(data)
+		return moveToDLQ(db, message)
+	default:
+		message.LastError = fmt.Sprintf("callback returned status %s", data.Status)
 		handleRetry(message)
+		if data.Interval != 0 {
+			message.NextRetry = currentTime + data.Interval
+		}
+	}
+	return saveScheduledRetry(db, message)
+}
+
+// saveScheduledRetry saves the message, or moves it to the DLQ when its next attempt would fall after the delivery deadline
+func saveScheduledRetry(db *gorm.DB, message *models.MessageQueue) error {
+	if message.Status == models.PENDING && deliveryDeadlinePassed(message, message.NextRetry) {
+		return moveToDLQAfterDeadline(db, message)
 	}
 	return messageQueueRepository.Save(db, message)
 }
 
+// deliveryDeadlinePassed reports whether an attempt at the given unix time would be after the message delivery deadline
+func deliveryDeadlinePassed(message *models.MessageQueue, at int64) bool {
+	return message.DeliveryDeadline != 0 && at >= message.DeliveryDeadline
+}
+
+// deadlineExceeded starts the last error of the messages moved to the DLQ after their delivery deadline
+const deadlineExceeded = "delivery deadline exceeded"
+
+func moveToDLQAfterDeadline(db *gorm.DB, message *models.MessageQueue) error {
+	lg.Info().Msgf("Message ID %d exceeded its delivery deadline, moving to DLQ", message.ID)
+	message.Status = models.PENDING
+	if message.LastError == "" {
+		message.LastError = deadlineExceeded
+	} else if !strings.HasPrefix(message.LastError, deadlineExceeded) {
+		message.LastError = deadlineExceeded + ", last error: " + message.LastError
+	}
+	return moveToDLQ(db, message)
+}
+
+func nonRetryableReason(data *models.Data) string {
+	if data.Reason == "" {
+		return "callback returned status " + StatusNonRetryable
+	}
+	return data.Reason
+}
+
+// processCronMessage delivers one cron occurrence. Every delivered occurrence counts towards retry_count,
+// and the next occurrence is scheduled after time_duration unless the callback answers otherwise.
 func processCronMessage(db *gorm.DB, message *models.MessageQueue) error {
+	host := callbackHost(message.CallbackUrl)
+	allowed, probe, deferUntil := allowCallback(db, host)
+	if !allowed {
+		return deferMessage(db, message, deferUntil)
+	}
+
 	callbackResponse, err := sendCallback(message)
+	recordCallbackResult(db, host, probe, err)
+	if err == nil {
+		storeCallbackResult(message, callbackResponse.Raw)
+		err = normalizeCallbackData(&callbackResponse.Data)
+	}
+
+	currentTime := time.Now().Unix()
 	message.Status = models.PENDING
-	finalRetry := message.TimeDuration
+	message.RetryCount++
+	message.NextRetry = currentTime + message.TimeDuration
 	if err != nil {
 		lg.Error().Msgf("Error sending callback: %v", err)
-	} else if callbackResponse.Data.Status == StatusSuccess {
+		message.LastError = err.Error()
+
+		if isBlockedAddress(err) {
+			return moveToDLQ(db, message)
+		}
+
+		var statusErr *CallbackStatusError
+		if errors.As(err, &statusErr) {
+			if statusErr.NonRetryable {
+				return moveToDLQ(db, message)
+			}
+			if !statusErr.RetryAfter.IsZero() {
+				message.NextRetry = statusErr.RetryAfter.Unix()
+			}
+		}
+		return messageQueueRepository.Save(db, message)
+	}
+
+	data := &callbackResponse.Data
+	switch data.Status {
+	case StatusSuccess:
 		message.Status = models.COMPLETED
-	} else if callbackResponse.Data.Status == StatusFailure && callbackResponse.Data.Interval != 0 {
-		finalRetry = callbackResponse.Data.Interval
+		queueTerminalNotification(message, models.NotifyCompleted)
+		message.LastError = ""
+	case StatusRetryAt:
+		message.NextRetry = data.RetryAt
+	case StatusReschedule:
+		message.NextRetry = data.NextRetry
+		if len(data.Payload) > 0 {
+			message.Payload = data.Payload
+		}
+	case StatusCancel:
+		message.Status = models.CANCELLED
+	case StatusNonRetryable:
+		lg.Info().Msgf("Cron message ID %d is non-retryable: %s", message.ID, data.Reason)
+		message.LastError = nonRetryableReason(data)
+		return moveToDLQ(db, message)
+	default:
+		message.LastError = fmt.Sprintf("callback returned status %s", data.Status)
+		if data.Interval != 0 {
+			message.NextRetry = currentTime + data.Interval
+		}
 	}
-	message.RetryCount++
-	message.NextRetry = time.Now().Unix() + finalRetry
 	return messageQueueRepository.Save(db, message)
 }
 
-func sendCallback(message *models.MessageQueue) (*models.CallbackResponseDTO, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+// rescheduleMessage moves a SCHEDULED message to the requested time without consuming a retry
+func rescheduleMessage(message *models.MessageQueue, data *models.Data) {
+	message.NextRetry = data.NextRetry
+	if len(data.Payload) > 0 {
+		message.Payload = data.Payload
+	}
+}
+
+// callbackRequest describes a single outbound callback HTTP request
+type callbackRequest struct {
+	Method      string
+	Url         string
+	Headers     map[string]string
+	QueryParams map[string]string
+	ServiceName string
+	UserId      string
+	Body        []byte
+	Timeout     time.Duration
+	Deadline    time.Time
+	TLSProfile  string
+	// Delivery is sent as metadata headers when set
+	Delivery *deliveryContext
+}
 
-	requestBody, err := json.Marshal(message.Payload)
+func sendCallback(message *models.MessageQueue) (response *models.CallbackResponseDTO, err error) {
+	delivery := newDeliveryContext(message)
+	ctx, span := startDispatchSpan(message, delivery)
+	defer func() { endDispatchSpan(span, err) }()
+
+	payload, err := deliveryPayload(message, delivery)
+	if err != nil {
+		return nil, err
+	}
+
+	requestBody, err := json.Marshal(payload)
 	if err != nil {
 		lg.Error().Msgf("error marshalling Payload: %v", message.Payload)
 		return nil, err
 	}
 
+	method := message.HttpMethod
+	if method == "" {
+		method = http.MethodPost
+	}
+
 	// Log the request body for debugging
-	lg.Info().Msgf("Sending JSON payload to %s: %s", message.CallbackUrl, string(requestBody))
+	lg.Info().Msgf("Sending JSON payload with %s to %s: %s", method, message.CallbackUrl, string(requestBody))
+
+	var callbackResponse models.CallbackResponseDTO
+	emptySuccess, err := doCallback(ctx, callbackRequest{
+		Method:      method,
+		Url:         message.CallbackUrl,
+		Headers:     message.Headers,
+		QueryParams: message.QueryParams,
+		ServiceName: message.ServiceName,
+		UserId:      message.UserId,
+		Body:        requestBody,
+		Timeout:     callbackTimeout(message),
+		Deadline:    deliveryDeadline(message),
+		TLSProfile:  message.TLSProfile,
+		Delivery:    &delivery,
+	}, &callbackResponse)
+	if err != nil {
+		return nil, err
+	}
+	if emptySuccess {
+		callbackResponse.Data.Status = StatusSuccess
+	}
+
+	return &callbackResponse, nil
+}
+
+// doCallback sends the callback request through the dispatcher of its URL scheme and decodes the JSON response into response.
+// emptySuccess reports a response without a body that counts as success, either a 2xx response when enabled in the
+// outcome rules or a publish onto an event bus.
+func doCallback(ctx context.Context, callback callbackRequest, response interface{}) (emptySuccess bool, err error) {
+	resp, err := dispatchCallback(ctx, callback)
+	if err != nil {
+		return false, err
+	}
+
+	// Publishing onto an event bus counts as delivery
+	if resp.NoReply {
+		return true, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, classifyStatus(resp.StatusCode, resp.Header, time.Now())
+	}
+
+	if len(bytes.TrimSpace(resp.Body)) == 0 && models.AppConfig.CallbackOutcomes.EmptyBodySuccess {
+		return true, nil
+	}
+
+	return false, json.Unmarshal(resp.Body, response)
+}
+
+// dispatchCallback builds the signed callback request and sends it through the dispatcher of its URL scheme.
+// The trace context of ctx is propagated in the request headers.
+func dispatchCallback(ctx context.Context, callback callbackRequest) (*dispatcher.Response, error) {
+	timeout := callback.Timeout
+	if timeout <= 0 {
+		timeout = time.Duration(models.AppConfig.CallbackTimeoutDefault) * time.Second
+	}
+
+	// The delivery deadline caps the attempt when it is closer than the callback timeout
+	timeoutErr := fmt.Errorf("callback timeout of %s exceeded", timeout)
+	deadline := time.Now().Add(timeout)
+	if !callback.Deadline.IsZero() && callback.Deadline.Before(deadline) {
+		deadline = callback.Deadline
+		timeoutErr = fmt.Errorf("delivery deadline exceeded during callback")
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	callbackUrl, err := url.Parse(callback.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid callback URL: %v", err)
+	}
+	if len(callback.QueryParams) > 0 {
+		query := callbackUrl.Query()
+		for key, value := range callback.QueryParams {
+			query.Set(key, value)
+		}
+		callbackUrl.RawQuery = query.Encode()
+	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", message.CallbackUrl, bytes.NewBuffer(requestBody))
+	callbackDispatcher, err := callbackDispatchers.For(callbackUrl)
 	if err != nil {
 		return nil, err
 	}
 
-	internalApiToken, err := middleware.GenerateApiToken(message.ServiceName, message.UserId)
+	// GET requests carry the payload only through the query parameters
+	var body []byte
+	if callback.Method != http.MethodGet {
+		body = callback.Body
+	}
+
+	internalApiToken, err := middleware.GenerateApiToken(callback.ServiceName, callback.UserId)
 	if err != nil {
 		return nil, fmt.Errorf("error generating internal API token: %v", err)
 	}
 
-	req.Header.Set("Content-Type", ContentTypeApplicationJSON)
-	req.Header.Set("internal-api-token", internalApiToken)
+	header := make(http.Header)
+	for name, value := range callback.Headers {
+		if models.IsDeniedCallbackHeader(name) {
+			continue
+		}
+		header.Set(name, value)
+	}
+	if body != nil {
+		header.Set("Content-Type", ContentTypeApplicationJSON)
+	}
+	header.Set("internal-api-token", internalApiToken)
+	header.Set(CallbackProtocolHeader, strconv.Itoa(CallbackProtocolVersion))
+	if callback.Delivery != nil {
+		callback.Delivery.setHeaders(header)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+
+	// Sign the exact bytes sent so that external receivers can verify the callback
+	if secret := models.AppConfig.GetServiceConfig(callback.ServiceName).SigningSecret; secret != "" {
+		timestamp := time.Now().Unix()
+		header.Set(webhook.TimestampHeader, strconv.FormatInt(timestamp, 10))
+		header.Set(webhook.SignatureHeader, webhook.Sign([]byte(secret), timestamp, body))
+	}
 
-	client := &http.Client{
-		Timeout: 30 * time.Second, // Redundant safety net in case context timeout fails
+	// The profile of the message takes precedence over the profile of the service
+	tlsProfile := callback.TLSProfile
+	if tlsProfile == "" {
+		tlsProfile = models.AppConfig.GetServiceConfig(callback.ServiceName).TLSProfile
 	}
 
-	resp, err := client.Do(req)
+	resp, err := callbackDispatcher.Dispatch(ctx, &dispatcher.Request{
+		Method:      callback.Method,
+		Url:         callbackUrl,
+		Header:      header,
+		Body:        body,
+		TLSProfile:  tlsProfile,
+		ServiceName: callback.ServiceName,
+	})
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			return nil, fmt.Errorf("callback timeout exceeded: %v", err)
+			return nil, fmt.Errorf("%v: %w", timeoutErr, err)
 		}
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return resp, nil
+}
 
-	var response models.CallbackResponseDTO
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return nil, err
+// callbackTimeout returns the per attempt timeout of the message, bounded by the configured maximum
+func callbackTimeout(message *models.MessageQueue) time.Duration {
+	seconds := message.CallbackTimeout
+	if seconds <= 0 {
+		seconds = int64(models.AppConfig.CallbackTimeoutDefault)
+	}
+	if seconds > int64(models.AppConfig.CallbackTimeoutMax) {
+		seconds = int64(models.AppConfig.CallbackTimeoutMax)
 	}
+	return time.Duration(seconds) * time.Second
+}
 
-	return &response, nil
+// deliveryDeadline returns the delivery deadline of a SCHEDULED message, CRON occurrences are not bounded by it
+func deliveryDeadline(message *models.MessageQueue) time.Time {
+	if message.DeliveryDeadline == 0 || message.MessageType == models.CRON {
+		return time.Time{}
+	}
+	return time.Unix(message.DeliveryDeadline, 0)
 }
 
 func handleRetry(message *models.MessageQueue) {
@@ -116,30 +435,74 @@ func handleRetry(message *models.MessageQueue) {
 	message.NextRetry = time.Now().Unix() + int64(message.RetryCount)
 }
 
-func EnqueueMessage(messageQueue models.MessageQueue) (uint, error) {
+// EnqueueMessage stores the message. tokenService is the service of the token of the request, the body may name
+// another service, in which case the callback URLs must pass the allowlists of both.
+func EnqueueMessage(ctx context.Context, messageQueue models.MessageQueue, tokenService string) (uint, models.EnqueueOutcomeEnums, error) {
+	if err := validateCallbackUrls(&messageQueue, tokenService); err != nil {
+		return 0, "", err
+	}
+
 	db, err := config.GetDBConnection()
 	if err != nil {
-		return 0, fmt.Errorf("error getting database connection: %v", err)
+		return 0, "", fmt.Errorf("error getting database connection: %v", err)
 	}
 
 	message := models.MessageQueue{
-		Payload:      messageQueue.Payload,
-		CallbackUrl:  messageQueue.CallbackUrl,
-		Status:       messageQueue.Status,
-		IsDLQ:        messageQueue.IsDLQ,
-		RetryCount:   messageQueue.RetryCount,
-		NextRetry:    messageQueue.NextRetry,
-		ServiceName:  messageQueue.ServiceName,
-		UserId:       messageQueue.UserId,
-		Count:        messageQueue.Count,
-		MessageType:  messageQueue.MessageType,
-		TimeDuration: messageQueue.TimeDuration,
+		Payload:          messageQueue.Payload,
+		CallbackUrl:      messageQueue.CallbackUrl,
+		Status:           messageQueue.Status,
+		IsDLQ:            messageQueue.IsDLQ,
+		RetryCount:       messageQueue.RetryCount,
+		NextRetry:        messageQueue.NextRetry,
+		ServiceName:      messageQueue.ServiceName,
+		UserId:           messageQueue.UserId,
+		Count:            messageQueue.Count,
+		MessageType:      messageQueue.MessageType,
+		TimeDuration:     messageQueue.TimeDuration,
+		DedupeKey:        messageQueue.DedupeKey,
+		DedupeMode:       messageQueue.DedupeMode,
+		BatchCallback:    messageQueue.BatchCallback,
+		HttpMethod:       messageQueue.HttpMethod,
+		Headers:          messageQueue.Headers,
+		QueryParams:      messageQueue.QueryParams,
+		CallbackTimeout:  messageQueue.CallbackTimeout,
+		DeliveryDeadline: messageQueue.DeliveryDeadline,
+		TLSProfile:       messageQueue.TLSProfile,
+		OnSuccessUrl:     messageQueue.OnSuccessUrl,
+		OnDeadUrl:        messageQueue.OnDeadUrl,
+		OnDlqUrl:         messageQueue.OnDlqUrl,
+		StoreResult:      messageQueue.StoreResult,
+		ScheduledAt:      messageQueue.ScheduledAt,
+		PayloadTemplate:  messageQueue.PayloadTemplate,
+		TraceParent:      traceParent(ctx),
+	}
+
+	outcome, err := enqueue(db, &message)
+	if err != nil {
+		return 0, "", err
 	}
-	if err := messageQueueRepository.Save(db, &message); err != nil {
-		return 0, err
+
+	switch outcome {
+	case models.DEBOUNCED:
+		lg.Info().Msgf("Message with id %d debounced with dedupe key %s", message.ID, message.DedupeKey)
+	case models.THROTTLED:
+		lg.Info().Msgf("Message with dedupe key %s dropped, pending message with id %d exists", message.DedupeKey, message.ID)
+	default:
+		lg.Info().Msgf("Message with id %d pushed to MessageQueue table", message.ID)
+	}
+	return message.ID, outcome, nil
+}
+
+// enqueue inserts the new message, or applies its dedupe mode when it has a dedupe key
+func enqueue(db *gorm.DB, message *models.MessageQueue) (models.EnqueueOutcomeEnums, error) {
+	switch {
+	case message.DedupeKey == "":
+		return models.CREATED, messageQueueRepository.Save(db, message)
+	case message.DedupeMode == models.THROTTLE:
+		return messageQueueRepository.InsertThrottled(db, message)
+	default:
+		return messageQueueRepository.UpsertDebounced(db, message)
 	}
-	lg.Info().Msgf("Message with id %d pushed to MessageQueue table", message.ID)
-	return message.ID, nil
 }
 
 func setMessageStatusInProgress(db *gorm.DB, message *models.MessageQueue) error {
@@ -150,18 +513,27 @@ func setMessageStatusInProgress(db *gorm.DB, message *models.MessageQueue) error
 	}
 
 	// Check current status to avoid double processing
-	var currentStatus string
-	tx.Model(&models.MessageQueue{}).Where("id = ?", message.ID).Select("status").Scan(&currentStatus)
-	if currentStatus != string(models.PENDING) {
+	var current models.MessageQueue
+	tx.Model(&models.MessageQueue{}).Scopes(repositories.PartitionPruning(message)).Where("id = ?", message.ID).Select("status", "next_retry", "updated_at").Scan(&current)
+	if current.Status != models.PENDING {
 		tx.Rollback()
 		return fmt.Errorf("message ID %d is not in PENDING status", message.ID)
 	}
 
-	// Update status to IN_PROGRESS
-	if err := tx.Model(message).Update("status", models.INPROGRESS).Error; err != nil {
+	// A debounced enqueue may have pushed the message out or replaced its payload since it was scanned
+	if current.NextRetry != message.NextRetry || !current.UpdatedAt.Equal(message.UpdatedAt) {
+		tx.Rollback()
+		return fmt.Errorf("message ID %d was rescheduled since it was scanned", message.ID)
+	}
+
+	// Update status to IN_PROGRESS under a lease, the reaper returns the message to PENDING if the lease expires
+	leaseUntil := time.Now().Unix() + int64(models.AppConfig.ClaimLease)
+	if err := tx.Model(message).Scopes(repositories.PartitionPruning(message)).Updates(map[string]interface{}{"status": models.INPROGRESS, "claimed_by": replicaID, "lease_until": leaseUntil}).Error; err != nil {
 		tx.Rollback()
 		return err
 	}
+	message.ClaimedBy = replicaID
+	message.LeaseUntil = leaseUntil
 
 	// Commit the status update before proceeding to process
 	if err := tx.Commit().Error; err != nil {
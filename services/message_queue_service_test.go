@@ -0,0 +1,72 @@
+package services
+
+import (
+	"encoding/json"
+	"schedulerV2/migrations/migrationstest"
+	"schedulerV2/models"
+	"schedulerV2/repositories"
+	"testing"
+	"time"
+)
+
+func TestSetMessageStatusInProgressAfterDebounce(t *testing.T) {
+	db := migrationstest.Open(t)
+	withAppConfig(t, models.Config{ClaimLease: 60})
+	messageQueueRepository = repositories.NewMessageQueueRepository()
+
+	nextRetry := time.Now().Unix()
+	enqueue := func(payload string) *models.MessageQueue {
+		message := &models.MessageQueue{
+			Payload:     json.RawMessage(payload),
+			CallbackUrl: "https://example.com/callback",
+			NextRetry:   nextRetry,
+			ServiceName: "billing",
+			MessageType: models.SCHEDULED,
+			DedupeKey:   "order-1",
+			DedupeMode:  models.DEBOUNCE,
+		}
+		if _, err := messageQueueRepository.UpsertDebounced(db, message); err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+
+	var scanned models.MessageQueue
+	if err := db.First(&scanned, enqueue(`{"v": 1}`).ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	// The debounce keeps next_retry and only replaces the payload
+	enqueue(`{"v": 2}`)
+
+	if err := setMessageStatusInProgress(db, &scanned); err == nil {
+		t.Error("message scanned before the debounce was claimed with its old payload")
+	}
+}
+
+func TestEnqueueWithoutDedupeKey(t *testing.T) {
+	db := migrationstest.Open(t)
+	messageQueueRepository = repositories.NewMessageQueueRepository()
+
+	for i := 0; i < 2; i++ {
+		message := &models.MessageQueue{
+			Payload:     json.RawMessage(`{}`),
+			CallbackUrl: "https://example.com/callback",
+			Status:      models.PENDING,
+			NextRetry:   time.Now().Unix(),
+			ServiceName: "billing",
+			MessageType: models.SCHEDULED,
+		}
+		outcome, err := enqueue(db, message)
+		if err != nil || outcome != models.CREATED || message.ID == 0 {
+			t.Fatalf("enqueue = %s, %v with id %d, want a CREATED message", outcome, err, message.ID)
+		}
+	}
+
+	var count int64
+	if err := db.Model(&models.MessageQueue{}).Where("service_name = ?", "billing").Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("%d messages stored, want 2", count)
+	}
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"fmt"
+	"schedulerV2/config"
+	"schedulerV2/models"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// storeCallbackResult keeps the response body on messages enqueued with storeResult, capped at CallbackResultMaxBytes.
+// The result is saved with the rest of the message once the callback outcome is applied.
+func storeCallbackResult(message *models.MessageQueue, body []byte) {
+	if !message.StoreResult || len(body) == 0 {
+		return
+	}
+
+	maxBytes := models.AppConfig.CallbackResultMaxBytes
+	message.ResultTruncated = len(body) > maxBytes
+	if message.ResultTruncated {
+		// Cut before the rune spanning the cap, the text column only takes valid UTF-8
+		cut := maxBytes
+		for cut > 0 && !utf8.RuneStart(body[cut]) {
+			cut--
+		}
+		body = body[:cut]
+	}
+	message.Result = strings.ToValidUTF8(string(body), "\uFFFD")
+	message.ResultAt = time.Now().Unix()
+}
+
+// GetMessageResult returns the stored result of a message of the service. found is false when the service has no
+// such message.
+func GetMessageResult(serviceName string, id uint) (result *models.MessageResultDTO, found bool, err error) {
+	db, err := config.GetDBConnection()
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting database connection: %v", err)
+	}
+
+	message, err := messageQueueRepository.FindByIDAndServiceName(db, id, serviceName)
+	if err == gorm.ErrRecordNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &models.MessageResultDTO{
+		ID:              message.ID,
+		Status:          message.Status,
+		IsDLQ:           message.IsDLQ,
+		Result:          message.Result,
+		ResultTruncated: message.ResultTruncated,
+		ResultAt:        message.ResultAt,
+	}, true, nil
+}
@@ -0,0 +1,36 @@
+package services
+
+import (
+	"schedulerV2/models"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestStoreCallbackResult(t *testing.T) {
+	withAppConfig(t, models.Config{CallbackResultMaxBytes: 8})
+
+	tests := []struct {
+		name          string
+		body          string
+		wantResult    string
+		wantTruncated bool
+	}{
+		{"under the cap", "héllo", "héllo", false},
+		{"cut at a rune boundary", "abcdefé€", "abcdefé", true},
+		{"cut inside a rune", "abcdefgé", "abcdefg", true},
+		{"cut inside a rune at the start", "€€€€", "€€", true},
+		{"invalid bytes", "ab\xffcd", "ab�cd", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := &models.MessageQueue{StoreResult: true}
+			storeCallbackResult(message, []byte(test.body))
+			if message.Result != test.wantResult || message.ResultTruncated != test.wantTruncated {
+				t.Errorf("result %q truncated %v, want %q truncated %v", message.Result, message.ResultTruncated, test.wantResult, test.wantTruncated)
+			}
+			if !utf8.ValidString(message.Result) {
+				t.Errorf("result %q is not valid UTF-8", message.Result)
+			}
+		})
+	}
+}
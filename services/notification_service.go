@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"schedulerV2/config"
+	"schedulerV2/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// maxNotificationAttempts is how many times a terminal state notification is sent before it is given up
+	maxNotificationAttempts = 10
+	maxNotificationBackoff  = 300
+)
+
+// queueTerminalNotification marks the notification of the terminal state as pending when the message or its service
+// has a URL for it. It is called before the save that moves the message into the terminal state, so the notification
+// is recorded with the transition and sent once by sendTerminalNotifications.
+func queueTerminalNotification(message *models.MessageQueue, event models.NotificationEventEnums) {
+	if notificationUrl(message, event) == "" {
+		return
+	}
+	message.NotificationEvent = event
+	message.NotificationStatus = models.NotificationPending
+	message.NotifyAt = time.Now().Unix()
+	message.NotifyAttempts = 0
+}
+
+// clearTerminalNotification undoes queueTerminalNotification when the transition was not saved
+func clearTerminalNotification(message *models.MessageQueue) {
+	message.NotificationEvent = ""
+	message.NotificationStatus = ""
+	message.NotifyAt = 0
+}
+
+// moveToDLQ moves the message to the DLQ and queues its DLQ notification
+func moveToDLQ(db *gorm.DB, message *models.MessageQueue) error {
+	queueTerminalNotification(message, models.NotifyDLQ)
+	if err := messageQueueRepository.MoveToDLQ(db, message); err != nil {
+		clearTerminalNotification(message)
+		return err
+	}
+	return nil
+}
+
+// notificationUrl returns the URL of the event set on the message, or else on its service
+func notificationUrl(message *models.MessageQueue, event models.NotificationEventEnums) string {
+	service := models.AppConfig.GetServiceConfig(message.ServiceName)
+	var messageUrl, serviceUrl string
+	switch event {
+	case models.NotifyCompleted:
+		messageUrl, serviceUrl = message.OnSuccessUrl, service.OnSuccessUrl
+	case models.NotifyDead:
+		messageUrl, serviceUrl = message.OnDeadUrl, service.OnDeadUrl
+	case models.NotifyDLQ:
+		messageUrl, serviceUrl = message.OnDlqUrl, service.OnDlqUrl
+	}
+	if messageUrl != "" {
+		return messageUrl
+	}
+	return serviceUrl
+}
+
+// reachedEvent reports whether the message is still in the terminal state of the event. A transition whose save
+// failed leaves a queued notification behind that must not be sent.
+func reachedEvent(message *models.MessageQueue, event models.NotificationEventEnums) bool {
+	switch event {
+	case models.NotifyCompleted:
+		return message.Status == models.COMPLETED
+	case models.NotifyDead:
+		return message.Status == models.DEAD
+	case models.NotifyDLQ:
+		return message.IsDLQ
+	}
+	return false
+}
+
+func sendTerminalNotifications() {
+	db, err := config.GetDBConnection()
+	if err != nil {
+		lg.Error().Msgf("Error getting database connection: %v", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	messages, err := messageQueueRepository.FindPendingNotifications(db, now, models.AppConfig.MessagesLimit)
+	if err != nil {
+		lg.Error().Msgf("Error fetching pending notifications: %v", err)
+		return
+	}
+
+	for i := range messages {
+		message := &messages[i]
+
+		// The lease outlasts the attempt, an attempt cut short by a restart is retried once it expires
+		leaseUntil := now + int64(models.AppConfig.CallbackTimeoutMax) + 1
+		claimed, err := messageQueueRepository.ClaimNotification(db, message, leaseUntil)
+		if err != nil {
+			lg.Error().Msgf("Error claiming notification of message ID %d: %v", message.ID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		runJob(func() { sendTerminalNotification(db, message) })
+	}
+}
+
+// sendTerminalNotification sends the notification of the message and records the outcome, retrying with a backoff
+// until maxNotificationAttempts is reached
+func sendTerminalNotification(db *gorm.DB, message *models.MessageQueue) {
+	event := message.NotificationEvent
+	if !reachedEvent(message, event) {
+		lg.Info().Msgf("Dropping %s notification of message ID %d, the message is %s", event, message.ID, message.Status)
+		message.NotificationStatus = models.NotificationFailed
+		if err := messageQueueRepository.UpdateNotification(db, message); err != nil {
+			lg.Error().Msgf("Error updating notification of message ID %d: %v", message.ID, err)
+		}
+		return
+	}
+
+	err := notify(message, notificationUrl(message, event))
+	message.NotifyAttempts++
+	switch {
+	case err == nil:
+		message.NotificationStatus = models.NotificationSent
+		lg.Info().Msgf("Sent %s notification of message ID %d", event, message.ID)
+	case message.NotifyAttempts >= maxNotificationAttempts:
+		message.NotificationStatus = models.NotificationFailed
+		lg.Error().Msgf("Giving up %s notification of message ID %d after %d attempts: %v", event, message.ID, message.NotifyAttempts, err)
+	default:
+		backoff := int64(1) << message.NotifyAttempts
+		if backoff > maxNotificationBackoff {
+			backoff = maxNotificationBackoff
+		}
+		message.NotifyAt = time.Now().Unix() + backoff
+		lg.Error().Msgf("Error sending %s notification of message ID %d: %v", event, message.ID, err)
+	}
+
+	if err := messageQueueRepository.UpdateNotification(db, message); err != nil {
+		lg.Error().Msgf("Error updating notification of message ID %d: %v", message.ID, err)
+	}
+}
+
+// notificationAttempts returns the no of callbacks sent for the message. retry_count of a cron message counts every
+// delivered occurrence, that of a scheduled message only its retries, so the callback that finished it is added for a
+// COMPLETED message and for a message moved to the DLQ by its callback response. A message moved to the DLQ after
+// its retries, its delivery deadline or its leases ran out, or marked DEAD, was not sent again.
+func notificationAttempts(message *models.MessageQueue) int {
+	if message.MessageType == models.CRON {
+		return message.RetryCount
+	}
+	switch message.NotificationEvent {
+	case models.NotifyCompleted:
+		return message.RetryCount + 1
+	case models.NotifyDLQ:
+		if message.RetryCount < models.AppConfig.DlqMessageLimit && message.OrphanCount < models.AppConfig.MaxOrphanings &&
+			!strings.HasPrefix(message.LastError, deadlineExceeded) {
+			return message.RetryCount + 1
+		}
+	}
+	return message.RetryCount
+}
+
+// notify POSTs the terminal state of the message to the notification URL, any 2xx response acknowledges it
+func notify(message *models.MessageQueue, notificationUrl string) error {
+	status := string(message.Status)
+	if message.NotificationEvent == models.NotifyDLQ {
+		status = string(models.NotifyDLQ)
+	}
+
+	body, err := json.Marshal(models.TerminalNotificationDTO{
+		ID:          message.ID,
+		ServiceName: message.ServiceName,
+		UserId:      message.UserId,
+		Status:      status,
+		Attempts:    notificationAttempts(message),
+		LastError:   message.LastError,
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling notification: %v", err)
+	}
+
+	resp, err := dispatchCallback(context.Background(), callbackRequest{
+		Method:      http.MethodPost,
+		Url:         notificationUrl,
+		ServiceName: message.ServiceName,
+		UserId:      message.UserId,
+		Body:        body,
+		TLSProfile:  message.TLSProfile,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.NoReply && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("notification returned status %d", resp.StatusCode)
+	}
+	return nil
+}
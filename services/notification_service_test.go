@@ -0,0 +1,175 @@
+package services
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"schedulerV2/migrations/migrationstest"
+	"schedulerV2/models"
+	"schedulerV2/repositories"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// notificationRecorder serves callbacks with a fixed response on /callback and records the notifications POSTed
+// to /notify
+type notificationRecorder struct {
+	*httptest.Server
+	status        int
+	body          string
+	notifications chan models.TerminalNotificationDTO
+}
+
+func newNotificationRecorder(t *testing.T) *notificationRecorder {
+	t.Helper()
+	recorder := &notificationRecorder{status: http.StatusOK, notifications: make(chan models.TerminalNotificationDTO, 1)}
+	recorder.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/notify" {
+			var notification models.TerminalNotificationDTO
+			body, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &notification); err != nil {
+				t.Errorf("invalid notification %s: %v", body, err)
+			}
+			recorder.notifications <- notification
+			return
+		}
+		w.WriteHeader(recorder.status)
+		io.WriteString(w, recorder.body)
+	}))
+	t.Cleanup(recorder.Close)
+	return recorder
+}
+
+func TestTerminalNotificationAttempts(t *testing.T) {
+	db := migrationstest.Open(t)
+	withAppConfig(t, models.Config{
+		CallbackTimeoutDefault: 5,
+		CallbackTimeoutMax:     30,
+		DlqMessageLimit:        3,
+		MaxOrphanings:          3,
+		MessagesLimit:          10,
+		CallbackOutcomes:       &models.CallbackOutcomeConfig{NonRetryable4xx: true},
+		CircuitBreaker:         &models.CircuitBreakerConfig{},
+	})
+	withHTTPDispatchers(t)
+	messageQueueRepository = repositories.NewMessageQueueRepository()
+	thresholdRepository = repositories.NewServiceThresholdRepository()
+	recorder := newNotificationRecorder(t)
+
+	success := `{"data": {"status": "SUCCESS"}}`
+	tests := []struct {
+		name         string
+		messageType  models.MessageTypeEnums
+		retryCount   int
+		status       int
+		body         string
+		transition   func(db *gorm.DB, message *models.MessageQueue) error
+		wantStatus   string
+		wantAttempts int
+	}{
+		{"success on first try", models.SCHEDULED, 0, http.StatusOK, success, processScheduledMessage, "COMPLETED", 1},
+		{"success after retries", models.SCHEDULED, 2, http.StatusOK, success, processScheduledMessage, "COMPLETED", 3},
+		{"non-retryable status in body", models.SCHEDULED, 0, http.StatusOK, `{"data": {"status": "NON_RETRYABLE"}}`, processScheduledMessage, "DLQ", 1},
+		{"non-retryable HTTP status", models.SCHEDULED, 1, http.StatusGone, "", processScheduledMessage, "DLQ", 2},
+		{"retries exhausted", models.SCHEDULED, 3, http.StatusOK, "", moveToDLQ, "DLQ", 3},
+		{"delivery deadline passed", models.SCHEDULED, 2, http.StatusOK, "", moveToDLQAfterDeadline, "DLQ", 2},
+		{"cron occurrence completes", models.CRON, 4, http.StatusOK, success, processCronMessage, "COMPLETED", 5},
+		{"cron non-retryable", models.CRON, 0, http.StatusGone, "", processCronMessage, "DLQ", 1},
+		{"outside service threshold", models.SCHEDULED, 0, http.StatusOK, "", markDeadByThreshold, "DEAD", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder.status, recorder.body = test.status, test.body
+			message := &models.MessageQueue{
+				Payload:      json.RawMessage(`{}`),
+				CallbackUrl:  recorder.URL + "/callback",
+				Status:       models.INPROGRESS,
+				RetryCount:   test.retryCount,
+				NextRetry:    time.Now().Unix(),
+				Count:        -1,
+				ServiceName:  "billing",
+				MessageType:  test.messageType,
+				TimeDuration: 60,
+				OnSuccessUrl: recorder.URL + "/notify",
+				OnDeadUrl:    recorder.URL + "/notify",
+				OnDlqUrl:     recorder.URL + "/notify",
+			}
+			if err := db.Create(message).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			if err := test.transition(db, message); err != nil {
+				t.Fatalf("transition: %v", err)
+			}
+			var stored models.MessageQueue
+			if err := db.First(&stored, message.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if stored.NotificationStatus != models.NotificationPending {
+				t.Fatalf("notification status = %q, want PENDING", stored.NotificationStatus)
+			}
+			sendTerminalNotification(db, &stored)
+
+			select {
+			case notification := <-recorder.notifications:
+				if notification.Status != test.wantStatus || notification.Attempts != test.wantAttempts {
+					t.Errorf("notification %s with %d attempts, want %s with %d", notification.Status, notification.Attempts, test.wantStatus, test.wantAttempts)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no notification received")
+			}
+		})
+	}
+}
+
+// markDeadByThreshold claims the message while its service has used up its threshold
+func markDeadByThreshold(db *gorm.DB, message *models.MessageQueue) error {
+	now := time.Now().Unix()
+	if _, err := thresholdRepository.Upsert(db, &models.ServiceThreshold{ServiceName: message.ServiceName, Limit: 0, StartTime: now - 60, EndTime: now + 60}); err != nil {
+		return err
+	}
+	defer db.Where("service_name = ?", message.ServiceName).Delete(&models.ServiceThreshold{})
+	claimScheduledMessage(db, message)
+	return nil
+}
+
+func TestNotificationAttempts(t *testing.T) {
+	withAppConfig(t, models.Config{DlqMessageLimit: 3, MaxOrphanings: 2})
+
+	tests := []struct {
+		name        string
+		messageType models.MessageTypeEnums
+		event       models.NotificationEventEnums
+		retryCount  int
+		orphanCount int
+		lastError   string
+		want        int
+	}{
+		{"completed on first try", models.SCHEDULED, models.NotifyCompleted, 0, 0, "", 1},
+		{"completed after retries", models.SCHEDULED, models.NotifyCompleted, 2, 0, "", 3},
+		{"rejected by callback", models.SCHEDULED, models.NotifyDLQ, 1, 0, "callback returned non-retryable HTTP status 410", 2},
+		{"retries exhausted", models.SCHEDULED, models.NotifyDLQ, 3, 0, "callback returned HTTP status 500", 3},
+		{"delivery deadline passed", models.SCHEDULED, models.NotifyDLQ, 2, 0, deadlineExceeded, 2},
+		{"leases expired", models.SCHEDULED, models.NotifyDLQ, 1, 2, "lease of replica-1 expired while the message was IN-PROGRESS", 1},
+		{"dead before sending", models.SCHEDULED, models.NotifyDead, 0, 0, "", 0},
+		{"cron occurrences", models.CRON, models.NotifyCompleted, 5, 0, "", 5},
+		{"cron rejected", models.CRON, models.NotifyDLQ, 1, 0, "callback returned non-retryable HTTP status 410", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := &models.MessageQueue{
+				MessageType:       test.messageType,
+				NotificationEvent: test.event,
+				RetryCount:        test.retryCount,
+				OrphanCount:       test.orphanCount,
+				LastError:         test.lastError,
+			}
+			if got := notificationAttempts(message); got != test.want {
+				t.Errorf("notificationAttempts = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
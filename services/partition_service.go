@@ -0,0 +1,84 @@
+package services
+
+import (
+	"context"
+	"expvar"
+	"schedulerV2/config"
+	"schedulerV2/models"
+	"schedulerV2/partitioning"
+	"time"
+)
+
+// partitionLockName makes the partition maintenance a singleton across replicas
+const partitionLockName = "partitions"
+
+// Counters of the partition maintenance, published with expvar under "partitions"
+var (
+	partitionMetrics = expvar.NewMap("partitions")
+
+	partitionsCreated  = new(expvar.Int)
+	partitionsDetached = new(expvar.Int)
+	partitionsDropped  = new(expvar.Int)
+	partitionsKept     = new(expvar.Int)
+	partitionErrors    = new(expvar.Int)
+)
+
+func init() {
+	partitionMetrics.Set("created", partitionsCreated)
+	partitionMetrics.Set("detached", partitionsDetached)
+	partitionMetrics.Set("dropped", partitionsDropped)
+	partitionMetrics.Set("kept", partitionsKept)
+	partitionMetrics.Set("errors", partitionErrors)
+}
+
+// maintainPartitions creates the message_queue partitions ahead of time and detaches the expired ones
+func maintainPartitions() {
+	acquired, err := messageLocker.TryAcquire(context.Background(), partitionLockName)
+	if err != nil {
+		lg.Error().Msgf("Error acquiring the partition lock: %v", err)
+		return
+	}
+	if !acquired {
+		// Another replica is maintaining the partitions
+		return
+	}
+	defer func() {
+		if err := messageLocker.Release(context.Background(), partitionLockName); err != nil {
+			lg.Error().Msgf("Error releasing the partition lock: %v", err)
+		}
+	}()
+
+	db, err := config.GetDBConnection()
+	if err != nil {
+		lg.Error().Msgf("Error getting database connection: %v", err)
+		return
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		lg.Error().Msgf("Error getting database connection: %v", err)
+		return
+	}
+
+	manager := partitioning.NewManager(sqlDB, *models.AppConfig.Partitioning)
+	result, err := manager.Maintain(context.Background(), time.Now())
+	partitionsCreated.Add(int64(len(result.Created)))
+	partitionsDetached.Add(int64(len(result.Detached)))
+	partitionsDropped.Add(int64(len(result.Dropped)))
+	partitionsKept.Add(int64(len(result.Kept)))
+	for _, name := range result.Created {
+		lg.Info().Msgf("Created partition %s", name)
+	}
+	for _, name := range result.Detached {
+		lg.Info().Msgf("Detached partition %s", name)
+	}
+	for _, name := range result.Dropped {
+		lg.Info().Msgf("Detached and dropped partition %s", name)
+	}
+	for _, name := range result.Kept {
+		lg.Warn().Msgf("Partition %s is past retention but still holds live messages", name)
+	}
+	if err != nil {
+		partitionErrors.Add(1)
+		lg.Error().Msgf("Error maintaining partitions: %v", err)
+	}
+}
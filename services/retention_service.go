@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"expvar"
+	"schedulerV2/config"
+	"schedulerV2/models"
+	"schedulerV2/repositories"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// retentionLockName makes the retention job a singleton across replicas
+const retentionLockName = "retention"
+
+// maxRetentionBatches bounds a single run per scope, what is left is picked up by the next run
+const maxRetentionBatches = 100
+
+// Counters of the retention job, published with expvar under "retention". archived and deleted are keyed by service.
+var (
+	retentionMetrics = expvar.NewMap("retention")
+
+	retentionArchived = new(expvar.Map).Init()
+	retentionDeleted  = new(expvar.Map).Init()
+	retentionRuns     = new(expvar.Int)
+	retentionErrors   = new(expvar.Int)
+)
+
+var retentionRepository *repositories.RetentionRepository
+
+func init() {
+	retentionMetrics.Set("archived", retentionArchived)
+	retentionMetrics.Set("deleted", retentionDeleted)
+	retentionMetrics.Set("runs", retentionRuns)
+	retentionMetrics.Set("errors", retentionErrors)
+}
+
+// applyRetention archives or deletes the terminal messages past their retention period. The services with their own
+// retention_days are handled one by one, then every other service with the default period.
+func applyRetention() {
+	acquired, err := messageLocker.TryAcquire(context.Background(), retentionLockName)
+	if err != nil {
+		lg.Error().Msgf("Error acquiring the retention lock: %v", err)
+		return
+	}
+	if !acquired {
+		// Another replica is running the retention job
+		return
+	}
+	defer func() {
+		if err := messageLocker.Release(context.Background(), retentionLockName); err != nil {
+			lg.Error().Msgf("Error releasing the retention lock: %v", err)
+		}
+	}()
+
+	db, err := config.GetDBConnection()
+	if err != nil {
+		lg.Error().Msgf("Error getting database connection: %v", err)
+		return
+	}
+	retentionRuns.Add(1)
+
+	var overridden []string
+	for serviceName := range models.AppConfig.Services {
+		if models.AppConfig.Services[serviceName].RetentionDays != 0 {
+			overridden = append(overridden, serviceName)
+		}
+	}
+	sort.Strings(overridden)
+
+	for _, serviceName := range overridden {
+		days := models.AppConfig.Services[serviceName].RetentionDays
+		if days < 0 {
+			continue
+		}
+		applyRetentionToScope(db, repositories.RetentionScope{ServiceName: serviceName}, days)
+	}
+	applyRetentionToScope(db, repositories.RetentionScope{Excluded: overridden}, models.AppConfig.Retention.Days)
+}
+
+// applyRetentionToScope removes the expired messages of the scope in batches, each batch in its own statement so
+// locks are held briefly
+func applyRetentionToScope(db *gorm.DB, scope repositories.RetentionScope, days int) {
+	cfg := models.AppConfig.Retention
+	before := time.Now().AddDate(0, 0, -days)
+
+	for batch := 0; batch < maxRetentionBatches && !draining.Load(); batch++ {
+		var removed int64
+		var err error
+		if cfg.Mode == models.RetentionDelete {
+			removed, err = retentionRepository.DeleteFinished(db, scope, before, cfg.BatchSize)
+		} else {
+			removed, err = retentionRepository.ArchiveFinished(db, scope, before, cfg.BatchSize)
+		}
+		if err != nil {
+			retentionErrors.Add(1)
+			lg.Error().Msgf("Error applying the retention of %s: %v", retentionScopeName(scope), err)
+			return
+		}
+
+		if removed > 0 {
+			if cfg.Mode == models.RetentionDelete {
+				retentionDeleted.Add(retentionScopeName(scope), removed)
+			} else {
+				retentionArchived.Add(retentionScopeName(scope), removed)
+			}
+			lg.Info().Msgf("Retention removed %d messages of %s older than %d days (%s)", removed, retentionScopeName(scope), days, cfg.Mode)
+		}
+		if removed < int64(cfg.BatchSize) {
+			return
+		}
+	}
+}
+
+// retentionScopeName is the metrics key of the scope, services on the default period are counted together
+func retentionScopeName(scope repositories.RetentionScope) string {
+	if scope.ServiceName != "" {
+		return scope.ServiceName
+	}
+	return "default"
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	stopSchedulers     = make(chan struct{})
+	schedulersDone     = make(chan struct{})
+	stopSchedulersOnce sync.Once
+	schedulersStarted  atomic.Bool
+
+	// draining is set once the replica is shutting down, no new messages are claimed from then on
+	draining atomic.Bool
+	// inFlightJobs tracks the jobs started by the schedulers, each scan waits for the callbacks it sends
+	inFlightJobs sync.WaitGroup
+)
+
+// runJob runs a scheduler job in the background, tracked so Shutdown can wait for it
+func runJob(job func()) {
+	inFlightJobs.Add(1)
+	go func() {
+		defer inFlightJobs.Done()
+		job()
+	}()
+}
+
+// Shutdown stops the schedulers from claiming new messages and waits until ctx is done for the jobs in flight, then
+// closes the locker. Messages still IN-PROGRESS when ctx is done are returned to PENDING by the lease reaper of
+// another replica.
+func Shutdown(ctx context.Context) error {
+	draining.Store(true)
+	stopSchedulersOnce.Do(func() { close(stopSchedulers) })
+
+	drained := make(chan struct{})
+	go func() {
+		// No job is started once the ticker loop returned, so the wait group is not added to while waited on
+		if schedulersStarted.Load() {
+			<-schedulersDone
+		}
+		inFlightJobs.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		lg.Info().Msg("All in-flight jobs finished")
+	case <-ctx.Done():
+		err = fmt.Errorf("in-flight jobs did not finish before the shutdown deadline: %v", ctx.Err())
+	}
+
+	// Callback outcomes tallied since the last tick would be lost with the process
+	flushCallbackResults()
+
+	if callbackDispatchers != nil {
+		if closeErr := callbackDispatchers.Close(); closeErr != nil {
+			lg.Error().Msgf("Error closing the callback dispatchers: %v", closeErr)
+		}
+	}
+
+	if closer, ok := messageLocker.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil {
+			lg.Error().Msgf("Error closing the locker: %v", closeErr)
+		}
+	}
+	return err
+}
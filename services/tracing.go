@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"schedulerV2/models"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("schedulerV2/services")
+
+// traceParent returns the W3C traceparent of the span in ctx, empty when there is none
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// enqueuedSpanContext returns the span context of the request that enqueued the message
+func enqueuedSpanContext(message *models.MessageQueue) trace.SpanContext {
+	if message.TraceParent == "" {
+		return trace.SpanContext{}
+	}
+	carrier := propagation.MapCarrier{"traceparent": message.TraceParent}
+	return trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+}
+
+// startDispatchSpan starts the span of a callback dispatch. SCHEDULED messages continue the trace of the request
+// that enqueued them, CRON occurrences start their own trace linked to it since a cron outlives its enqueue by far.
+func startDispatchSpan(message *models.MessageQueue, delivery deliveryContext) (context.Context, trace.Span) {
+	ctx := context.Background()
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.Int64("scheduler.message.id", int64(message.ID)),
+			attribute.String("scheduler.message.type", string(message.MessageType)),
+			attribute.String("scheduler.service.name", message.ServiceName),
+			attribute.Int("scheduler.attempt", delivery.Attempt),
+			attribute.Int("scheduler.occurrence", delivery.Occurrence),
+		),
+	}
+
+	if enqueued := enqueuedSpanContext(message); enqueued.IsValid() {
+		if message.MessageType == models.CRON {
+			opts = append(opts, trace.WithNewRoot(), trace.WithLinks(trace.Link{SpanContext: enqueued}))
+		} else {
+			ctx = trace.ContextWithRemoteSpanContext(ctx, enqueued)
+		}
+	}
+	return tracer.Start(ctx, "callback.dispatch", opts...)
+}
+
+// startBatchDispatchSpan starts the span of a batched callback, linked to the enqueue trace of every message
+func startBatchDispatchSpan(chunk []*models.MessageQueue) (context.Context, trace.Span) {
+	var links []trace.Link
+	for _, msg := range chunk {
+		if enqueued := enqueuedSpanContext(msg); enqueued.IsValid() {
+			links = append(links, trace.Link{SpanContext: enqueued, Attributes: []attribute.KeyValue{attribute.Int64("scheduler.message.id", int64(msg.ID))}})
+		}
+	}
+
+	return tracer.Start(context.Background(), "callback.dispatch.batch",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			attribute.String("scheduler.service.name", chunk[0].ServiceName),
+			attribute.Int("scheduler.batch.size", len(chunk)),
+		),
+	)
+}
+
+// endDispatchSpan records the callback error, if any, and ends the span
+func endDispatchSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,112 @@
+// Package webhook signs scheduler callbacks and lets receivers verify them.
+//
+// The scheduler sends the unix timestamp of the delivery in the X-Scheduler-Timestamp header and
+// an HMAC-SHA256 over "<timestamp>.<body>" keyed with the service signing secret in the
+// X-Scheduler-Signature header, formatted as "v1=<hex digest>". During a secret rotation the
+// signature header may carry several comma separated signatures, any of which is accepted.
+//
+// The package only depends on the standard library so receivers can import it directly.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader  = "X-Scheduler-Signature"
+	TimestampHeader  = "X-Scheduler-Timestamp"
+	SignatureVersion = "v1"
+
+	// DefaultTolerance is the maximum accepted age of a delivery before it is considered a replay
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	ErrMissingSignature = errors.New("webhook: missing signature or timestamp header")
+	ErrInvalidTimestamp = errors.New("webhook: invalid timestamp header")
+	ErrExpiredTimestamp = errors.New("webhook: timestamp outside of the tolerance window")
+	ErrInvalidSignature = errors.New("webhook: signature mismatch")
+)
+
+// equalMAC compares digests in constant time, so the comparison does not leak how much of a forged digest matches
+var equalMAC = hmac.Equal
+
+// Sign returns the signature header value for the body sent at the given unix timestamp
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	return SignatureVersion + "=" + hex.EncodeToString(computeMAC(secret, timestamp, body))
+}
+
+// Verify checks the signature and timestamp header values against the body.
+// A tolerance of zero uses DefaultTolerance.
+func Verify(secret []byte, signatureHeader string, timestampHeader string, body []byte, tolerance time.Duration) error {
+	if signatureHeader == "" || timestampHeader == "" {
+		return ErrMissingSignature
+	}
+
+	timestamp, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrExpiredTimestamp
+	}
+
+	expected := computeMAC(secret, timestamp, body)
+	for _, signature := range strings.Split(signatureHeader, ",") {
+		version, digest, found := strings.Cut(strings.TrimSpace(signature), "=")
+		if !found || version != SignatureVersion {
+			continue
+		}
+		decoded, err := hex.DecodeString(digest)
+		if err != nil {
+			continue
+		}
+		if equalMAC(decoded, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// VerifyRequest verifies an incoming callback request and returns its body.
+// The request body is replaced so that it can still be read by the handler.
+func VerifyRequest(r *http.Request, secret []byte, tolerance time.Duration) ([]byte, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("webhook: reading body: %w", err)
+		}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := Verify(secret, r.Header.Get(SignatureHeader), r.Header.Get(TimestampHeader), body, tolerance); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func computeMAC(secret []byte, timestamp int64, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
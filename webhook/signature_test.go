@@ -0,0 +1,130 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret = []byte("s3cret")
+	testBody   = []byte(`{"id":42,"payload":{"amount":10}}`)
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Now().Unix()
+	valid := Sign(testSecret, now, testBody)
+	_, digest, _ := strings.Cut(valid, "=")
+
+	tests := []struct {
+		name      string
+		secret    []byte
+		signature string
+		timestamp string
+		body      []byte
+		tolerance time.Duration
+		wantErr   error
+	}{
+		{"valid", testSecret, valid, strconv.FormatInt(now, 10), testBody, 0, nil},
+		{"tampered body", testSecret, valid, strconv.FormatInt(now, 10), []byte(`{"id":42,"payload":{"amount":1000}}`), 0, ErrInvalidSignature},
+		{"empty body", testSecret, valid, strconv.FormatInt(now, 10), nil, 0, ErrInvalidSignature},
+		{"wrong secret", []byte("other"), valid, strconv.FormatInt(now, 10), testBody, 0, ErrInvalidSignature},
+		{"timestamp of another delivery", testSecret, valid, strconv.FormatInt(now-1, 10), testBody, 0, ErrInvalidSignature},
+		{"expired timestamp", testSecret, Sign(testSecret, now-600, testBody), strconv.FormatInt(now-600, 10), testBody, 0, ErrExpiredTimestamp},
+		{"future timestamp", testSecret, Sign(testSecret, now+600, testBody), strconv.FormatInt(now+600, 10), testBody, 0, ErrExpiredTimestamp},
+		{"within a custom tolerance", testSecret, Sign(testSecret, now-600, testBody), strconv.FormatInt(now-600, 10), testBody, time.Hour, nil},
+		{"outside a custom tolerance", testSecret, Sign(testSecret, now-120, testBody), strconv.FormatInt(now-120, 10), testBody, time.Minute, ErrExpiredTimestamp},
+		{"missing signature", testSecret, "", strconv.FormatInt(now, 10), testBody, 0, ErrMissingSignature},
+		{"missing timestamp", testSecret, valid, "", testBody, 0, ErrMissingSignature},
+		{"invalid timestamp", testSecret, valid, "yesterday", testBody, 0, ErrInvalidTimestamp},
+		{"rotation with the valid signature last", testSecret, "v1=" + strings.Repeat("0", 64) + ", " + valid, strconv.FormatInt(now, 10), testBody, 0, nil},
+		{"rotation with the valid signature first", testSecret, valid + ",v1=" + strings.Repeat("0", 64), strconv.FormatInt(now, 10), testBody, 0, nil},
+		{"malformed without version", testSecret, digest, strconv.FormatInt(now, 10), testBody, 0, ErrInvalidSignature},
+		{"malformed unknown version", testSecret, "v2=" + digest, strconv.FormatInt(now, 10), testBody, 0, ErrInvalidSignature},
+		{"malformed hex", testSecret, "v1=" + strings.Repeat("z", 64), strconv.FormatInt(now, 10), testBody, 0, ErrInvalidSignature},
+		{"malformed empty digest", testSecret, "v1=", strconv.FormatInt(now, 10), testBody, 0, ErrInvalidSignature},
+		{"malformed separators only", testSecret, ",,=,", strconv.FormatInt(now, 10), testBody, 0, ErrInvalidSignature},
+		{"truncated digest", testSecret, valid[:len(valid)-2], strconv.FormatInt(now, 10), testBody, 0, ErrInvalidSignature},
+		{"digest with trailing bytes", testSecret, valid + "00", strconv.FormatInt(now, 10), testBody, 0, ErrInvalidSignature},
+		{"uppercase digest", testSecret, "v1=" + strings.ToUpper(digest), strconv.FormatInt(now, 10), testBody, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.signature, tt.timestamp, tt.body, tt.tolerance)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignIsDeterministic(t *testing.T) {
+	first := Sign(testSecret, 1700000000, testBody)
+	if !strings.HasPrefix(first, SignatureVersion+"=") || len(first) != len("v1=")+64 {
+		t.Fatalf("got signature %q, want v1= and a hex SHA-256 digest", first)
+	}
+	if second := Sign(testSecret, 1700000000, testBody); second != first {
+		t.Errorf("signing twice gave %q and %q", first, second)
+	}
+	if other := Sign(testSecret, 1700000001, testBody); other == first {
+		t.Error("the timestamp is not part of the signature")
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	timestamp := time.Now().Unix()
+	req := httptest.NewRequest("POST", "/callback", bytes.NewReader(testBody))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(testSecret, timestamp, testBody))
+
+	body, err := VerifyRequest(req, testSecret, 0)
+	if err != nil {
+		t.Fatalf("valid request rejected: %v", err)
+	}
+	if !bytes.Equal(body, testBody) {
+		t.Errorf("got body %s, want %s", body, testBody)
+	}
+	// The handler can still read the body
+	if replay, _ := io.ReadAll(req.Body); !bytes.Equal(replay, testBody) {
+		t.Errorf("got request body %s after verification, want %s", replay, testBody)
+	}
+
+	req = httptest.NewRequest("POST", "/callback", bytes.NewReader([]byte(`{"id":43}`)))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(testSecret, timestamp, testBody))
+	if _, err := VerifyRequest(req, testSecret, 0); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("tampered request: got %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestVerifyComparesInConstantTime(t *testing.T) {
+	// Timing differences of a 32 byte comparison are too small to measure reliably, so the test checks that digests
+	// are compared with hmac.Equal, which runs in constant time for equal lengths
+	if reflect.ValueOf(equalMAC).Pointer() != reflect.ValueOf(hmac.Equal).Pointer() {
+		t.Fatal("digests are not compared with hmac.Equal")
+	}
+
+	previous := equalMAC
+	t.Cleanup(func() { equalMAC = previous })
+	var compared [][]byte
+	equalMAC = func(a, b []byte) bool {
+		compared = append(compared, a)
+		return previous(a, b)
+	}
+
+	now := time.Now().Unix()
+	forged := "v1=" + strings.Repeat("ab", 32)
+	if err := Verify(testSecret, forged+","+Sign(testSecret, now, testBody), strconv.FormatInt(now, 10), testBody, 0); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	if len(compared) != 2 {
+		t.Errorf("%d digests went through the constant time comparison, want every one of them", len(compared))
+	}
+}